@@ -0,0 +1,50 @@
+import { setTimeout as sleep } from 'timers/promises';
+import { loadConfig } from '../src/config.js';
+import { createDockerClient } from '../src/docker.js';
+import { createRunner, Runner } from '../src/runner.js';
+
+// Compares the latency of a trivial Python run in a fresh container with one
+// exec'd into a pooled container, against the Docker daemon the runner would
+// use. Usage: npm run bench [-- runs]
+const RUNS = parseInt(process.argv[2] || '20', 10);
+const REQUEST = { language: 'python', code: 'print("ok")' };
+
+const percentile = (sorted: number[], p: number): number =>
+  sorted[Math.min(sorted.length - 1, Math.floor((sorted.length * p) / 100))];
+
+const measure = async (runner: Runner): Promise<number[]> => {
+  // The first run may build the image.
+  await runner.execute(REQUEST);
+
+  const latencies: number[] = [];
+  for (let i = 0; i < RUNS; i++) {
+    // Gives the pool time to start the replacement container.
+    await sleep(500);
+    const start = performance.now();
+    const result = await runner.execute(REQUEST);
+    latencies.push(performance.now() - start);
+    if (result.exitCode !== 0) {
+      throw new Error(`Run failed: ${result.stderr}`);
+    }
+  }
+  return latencies.sort((a, b) => a - b);
+};
+
+const config = loadConfig();
+const docker = createDockerClient(config);
+
+for (const [mode, options] of [
+  ['fresh', {}],
+  ['pooled', { pool: { size: 2, languages: ['python'] } }],
+] as const) {
+  const runner = createRunner(docker, config, options);
+  try {
+    const latencies = await measure(runner);
+    console.log(
+      `${mode}: p50 ${percentile(latencies, 50).toFixed(0)}ms, ` +
+        `p95 ${percentile(latencies, 95).toFixed(0)}ms over ${RUNS} runs`
+    );
+  } finally {
+    await runner.close();
+  }
+}
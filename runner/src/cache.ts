@@ -0,0 +1,132 @@
+import { hashCode } from './crypto.js';
+import { ExecutionRequest, ExecutionResult } from './executor.js';
+import { imageTag } from './images.js';
+import { detectLanguage, getLanguage } from './languages.js';
+
+// Where cached results live. get resolves undefined for a missing or expired
+// entry; set keeps the result for ttl milliseconds.
+export interface ResultCacheStore {
+  get: (key: string) => Promise<ExecutionResult | undefined>;
+  set: (key: string, result: ExecutionResult, ttl: number) => Promise<void>;
+}
+
+export interface ResultCacheOptions {
+  // Defaults to an in-memory store of DEFAULT_MAX_ENTRIES results.
+  store?: ResultCacheStore;
+  ttl?: number;
+}
+
+export interface CacheStats {
+  hits: number;
+  misses: number;
+}
+
+export interface ResultCache {
+  // undefined when the request may not be cached.
+  key: (request: ExecutionRequest) => string | undefined;
+  get: (key: string) => Promise<ExecutionResult | undefined>;
+  set: (key: string, result: ExecutionResult) => Promise<void>;
+  stats: () => CacheStats;
+}
+
+const DEFAULT_TTL = 60 * 60 * 1000;
+const DEFAULT_MAX_ENTRIES = 1000;
+
+// Keeps at most maxEntries results, evicting the oldest first.
+export const createMemoryCacheStore = (maxEntries = DEFAULT_MAX_ENTRIES): ResultCacheStore => {
+  const entries = new Map<string, { result: ExecutionResult; expires: number }>();
+
+  return {
+    get: async (key) => {
+      const entry = entries.get(key);
+      if (!entry) {
+        return undefined;
+      }
+      if (entry.expires <= Date.now()) {
+        entries.delete(key);
+        return undefined;
+      }
+      return entry.result;
+    },
+    set: async (key, result, ttl) => {
+      entries.delete(key);
+      entries.set(key, { result, expires: Date.now() + ttl });
+      while (entries.size > maxEntries) {
+        entries.delete(entries.keys().next().value!);
+      }
+    },
+  };
+};
+
+// Object keys are sorted so that equal requests serialize, and hash, the same
+// regardless of the order their fields were set in.
+const sortKeys = (_key: string, value: unknown): unknown => {
+  if (value === null || typeof value !== 'object' || Array.isArray(value)) {
+    return value;
+  }
+  const entries = Object.entries(value as Record<string, unknown>);
+  return Object.fromEntries(entries.sort(([a], [b]) => (a < b ? -1 : a > b ? 1 : 0)));
+};
+
+// Only runs that ask for it are cached: deterministic ones, or ones the caller
+// marks cacheable because the program's output depends on its inputs alone.
+// The key covers every field that can change the result, i.e. all of them
+// but the signal, and the image the run would use, so that a new default
+// version or an edited Dockerfile doesn't serve results from the old one.
+// Requests for a language that isn't registered fail anyway and get no key.
+export const resultCacheKey = (request: ExecutionRequest): string | undefined => {
+  if (!request.deterministic && !request.cacheable) {
+    return undefined;
+  }
+  const name = request.language || detectLanguage(request.fileName ?? '');
+  const language = name ? getLanguage(name, request.version) : undefined;
+  if (!language) {
+    return undefined;
+  }
+  const { signal, ...inputs } = request;
+  return hashCode(JSON.stringify({ ...inputs, image: imageTag(language) }, sortKeys));
+};
+
+// Results go in and come out as copies, so that a caller changing the one it
+// was given, output file contents included, can't change what later hits get.
+const copyResult = (result: ExecutionResult): ExecutionResult => {
+  const copy = { ...result };
+  if (result.outputFiles) {
+    copy.outputFiles = Object.fromEntries(
+      Object.entries(result.outputFiles).map(([path, data]) => [path, Buffer.from(data)])
+    );
+  }
+  if (result.outputFileErrors) {
+    copy.outputFileErrors = { ...result.outputFileErrors };
+  }
+  return copy;
+};
+
+// A result is only worth keeping if it would come out the same next time; a
+// timeout depends on how loaded the host was.
+const reusable = (result: ExecutionResult): boolean => !result.timedOut;
+
+export const createResultCache = (options: ResultCacheOptions = {}): ResultCache => {
+  const store = options.store ?? createMemoryCacheStore();
+  const ttl = options.ttl ?? DEFAULT_TTL;
+  const stats: CacheStats = { hits: 0, misses: 0 };
+
+  return {
+    key: resultCacheKey,
+    get: async (key) => {
+      const result = await store.get(key);
+      if (!result) {
+        stats.misses++;
+        return undefined;
+      }
+      stats.hits++;
+      return copyResult(result);
+    },
+    set: async (key, result) => {
+      if (reusable(result)) {
+        await store.set(key, copyResult(result), ttl);
+      }
+    },
+    stats: () => ({ ...stats }),
+  };
+};
@@ -11,7 +11,23 @@ export interface RunnerConfig {
   concurrency: number;
   maxExecutionTime: number;
   maxMemory: number;
+  // No container gets network access, so requests for network access or for
+  // dependencies are refused.
   networkDisabled: boolean;
+  workspaceDir: string;
+  runtime?: string;
+  serverPort?: number;
+  // Build a missing language image on demand instead of failing the run.
+  autoBuildImages: boolean;
+  // Submitted source, in bytes: across all files, and for any one file.
+  maxSourceBytes: number;
+  maxSourceFileBytes: number;
+  // Mount a persistent volume per language for toolchain caches in the
+  // install and compile steps.
+  buildCacheVolumes: boolean;
+  // Remove stale language images at start-up. The images are shared by every
+  // runner on the Docker host, so this is meant for one of them only.
+  pruneImagesOnStart: boolean;
 }
 
 export const loadConfig = (): RunnerConfig => {
@@ -39,6 +55,14 @@ export const loadConfig = (): RunnerConfig => {
     maxExecutionTime: parseInt(process.env.MAX_EXECUTION_TIME || '10000', 10),
     maxMemory: parseInt(process.env.MAX_MEMORY || '536870912', 10),
     networkDisabled: process.env.NETWORK_DISABLED !== 'false',
+    workspaceDir: process.env.WORKSPACE_DIR || '/tmp/codecontest',
+    runtime: process.env.CONTAINER_RUNTIME || undefined,
+    serverPort: process.env.SERVER_PORT ? parseInt(process.env.SERVER_PORT, 10) : undefined,
+    autoBuildImages: process.env.AUTO_BUILD_IMAGES !== 'false',
+    maxSourceBytes: parseInt(process.env.MAX_SOURCE_BYTES || '4194304', 10),
+    maxSourceFileBytes: parseInt(process.env.MAX_SOURCE_FILE_BYTES || '1048576', 10),
+    buildCacheVolumes: process.env.BUILD_CACHE_VOLUMES === 'true',
+    pruneImagesOnStart: process.env.PRUNE_IMAGES_ON_START === 'true',
   };
 };
 
@@ -0,0 +1,32 @@
+import Docker from 'dockerode';
+import { RunnerConfig } from './config.js';
+
+// The part of the dockerode client the runner uses. Anything matching it can
+// be passed to createRunner, such as a fake in tests or a client configured
+// for a remote daemon.
+export type DockerClient = Pick<
+  Docker,
+  | 'buildImage'
+  | 'createContainer'
+  | 'createVolume'
+  | 'getContainer'
+  | 'getImage'
+  | 'getVolume'
+  | 'listContainers'
+  | 'listImages'
+  | 'listVolumes'
+  | 'info'
+  | 'ping'
+  | 'modem'
+>;
+
+// With DOCKER_HOST set the client is configured from the environment the way
+// the docker CLI is (DOCKER_HOST, DOCKER_TLS_VERIFY, DOCKER_CERT_PATH), which
+// covers remote and TLS daemons; otherwise it talks to the local socket.
+export const createDockerClient = (config: RunnerConfig): DockerClient => {
+  if (process.env.DOCKER_HOST) {
+    return new Docker();
+  }
+
+  return new Docker({ socketPath: config.dockerSocket });
+};
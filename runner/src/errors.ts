@@ -0,0 +1,113 @@
+// Errors the runner raises on purpose, so callers can tell them apart with
+// instanceof, e.g. to map them to HTTP status codes. The underlying error, if
+// any, is kept as `cause`.
+export class RunnerError extends Error {
+  constructor(message: string, options?: { cause?: unknown }) {
+    super(message, options);
+    this.name = new.target.name;
+    Object.setPrototypeOf(this, new.target.prototype);
+  }
+}
+
+export class UnknownLanguageError extends RunnerError {
+  constructor(
+    public language: string,
+    public version: string | undefined,
+    public available: string[]
+  ) {
+    super(
+      version === undefined
+        ? `Unsupported language: ${language} (supported: ${available.join(', ')})`
+        : `Unsupported version ${version} of ${language} (available: ${available.join(', ')})`
+    );
+  }
+}
+
+// The request itself is unacceptable: bad file paths, environment, network
+// settings, dependencies or similar.
+export class InvalidRequestError extends RunnerError {}
+
+export class DaemonUnreachableError extends RunnerError {
+  constructor(cause: unknown) {
+    super(`Docker daemon is unreachable: ${cause instanceof Error ? cause.message : cause}`, {
+      cause,
+    });
+  }
+}
+
+export class ImageBuildError extends RunnerError {
+  constructor(
+    public image: string,
+    public buildLog: string,
+    cause?: unknown
+  ) {
+    super(`Image build failed for ${image}${cause instanceof Error ? `: ${cause.message}` : ''}`, {
+      cause,
+    });
+  }
+}
+
+// The language's image is not on the daemon and was not built, either because
+// auto-build is off or because the image has no Dockerfile to build from.
+export class ImageNotBuiltError extends RunnerError {
+  constructor(
+    public language: string,
+    public image: string
+  ) {
+    super(`Image ${image} for ${language} has not been built`);
+  }
+}
+
+// file is set when a single file is over the per-file limit, and unset when
+// only the total is over.
+export class SourceTooLargeError extends RunnerError {
+  constructor(
+    public size: number,
+    public limit: number,
+    public file?: string
+  ) {
+    super(
+      file === undefined
+        ? `Source is ${size} bytes in total, over the limit of ${limit}`
+        : `Source file ${file} is ${size} bytes, over the limit of ${limit}`
+    );
+  }
+}
+
+export class WorkspaceSetupError extends RunnerError {
+  constructor(cause: unknown) {
+    super(`Failed to set up workspace: ${cause instanceof Error ? cause.message : cause}`, {
+      cause,
+    });
+  }
+}
+
+export class ShuttingDownError extends RunnerError {
+  constructor() {
+    super('Runner is shutting down');
+  }
+}
+
+const CONNECTION_ERROR_CODES = new Set(['ECONNREFUSED', 'ECONNRESET', 'EHOSTUNREACH', 'EPIPE']);
+
+// dockerode surfaces a missing or refused daemon as the raw socket error; a
+// missing socket file is ENOENT from connect().
+export const isDaemonUnreachable = (error: unknown): boolean => {
+  const { code, syscall } = (error ?? {}) as NodeJS.ErrnoException;
+  return code !== undefined && (syscall === 'connect' || CONNECTION_ERROR_CODES.has(code));
+};
+
+// Docker answers 404 to a create whose image is missing; the daemon itself
+// failing is a 5xx or a connection error.
+export const isImageNotFound = (error: unknown): boolean => {
+  return (error as { statusCode?: number } | undefined)?.statusCode === 404;
+};
+
+// Leaves the runner's own errors alone and turns connection failures into
+// DaemonUnreachableError.
+export const toRunnerError = (error: unknown): unknown => {
+  if (!(error instanceof RunnerError) && isDaemonUnreachable(error)) {
+    return new DaemonUnreachableError(error);
+  }
+  return error;
+};
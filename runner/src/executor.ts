@@ -1,7 +1,45 @@
 import Docker from 'dockerode';
+import { Writable } from 'stream';
+import { constants } from 'os';
+import { constants as fsConstants } from 'fs';
+import { randomUUID } from 'crypto';
+import {
+  access,
+  mkdir,
+  mkdtemp,
+  open,
+  realpath,
+  rename,
+  writeFile,
+  chmod,
+  rm,
+} from 'fs/promises';
+import { basename, dirname, join, posix, sep } from 'path';
 import { RunnerConfig } from './config.js';
-import { logger } from './logger.js';
+import { DockerClient } from './docker.js';
+import { logger, noopLogger, RunnerLogger } from './logger.js';
+import {
+  getLanguage,
+  listLanguages,
+  listVersions,
+  resolveEntryPoint,
+  detectLanguage,
+  DependencySupport,
+  EntryPoint,
+  Language,
+} from './languages.js';
+import { ensureImage, forgetImage, imageAvailable, imageTag, runnerLabels } from './images.js';
 import { hashCode } from './crypto.js';
+import { Runner } from './runner.js';
+import { resolveSeccompProfile } from './seccomp.js';
+import {
+  ImageNotBuiltError,
+  InvalidRequestError,
+  SourceTooLargeError,
+  UnknownLanguageError,
+  WorkspaceSetupError,
+  isImageNotFound,
+} from './errors.js';
 
 interface SubmissionJob {
   submissionId: string;
@@ -12,7 +50,121 @@ interface SubmissionJob {
   memoryLimit: number;
 }
 
-interface ExecutionResult {
+export type NetworkMode = 'none' | 'bridge';
+
+export interface Ulimit {
+  soft: number;
+  hard: number;
+}
+
+export interface ExecutionRequest {
+  // May be left out when fileName is given.
+  language?: string;
+  // Name of the submitted source file. Only used to detect the language from
+  // its extension; the source is still written to the language's own file.
+  fileName?: string;
+  // Defaults to the latest registered version of the language.
+  version?: string;
+  code?: string;
+  // Extra files keyed by path relative to /workspace. When code is also set
+  // it is written to the language's default file name first.
+  files?: Record<string, string>;
+  stdin?: string | Buffer;
+  args?: string[];
+  dependencies?: string[];
+  installTimeout?: number;
+  // Applies to the compile step only; timeout covers the run itself.
+  compileTimeout?: number;
+  env?: Record<string, string>;
+  allowUnsafeEnv?: boolean;
+  // Pins the environment for reproducible output. Every language gets TZ=UTC,
+  // LANG=C.UTF-8, LC_ALL=C.UTF-8 and SOURCE_DATE_EPOCH=0 (which gcc uses for
+  // __DATE__ and __TIME__); Python adds PYTHONHASHSEED=0 and Go adds
+  // GODEBUG=randautoseed=0. None of them may then be set through env. Java,
+  // JavaScript, Ruby and Rust have nothing further to pin from the
+  // environment, and the clock, Go map order and runtime RNGs stay as they are.
+  deterministic?: boolean;
+  // Lets Runner.execute reuse the result of an identical earlier request, as
+  // it does for deterministic ones, when a result cache is configured.
+  cacheable?: boolean;
+  // user[:group], by name or id, to run as instead of the image's runner
+  // user. Root is refused unless allowRootUser is set.
+  user?: string;
+  allowRootUser?: boolean;
+  timeout?: number;
+  memoryLimitBytes?: number;
+  pidsLimit?: number;
+  // CPU cores, e.g. 0.5. The timeout is wall-clock, so a throttled program
+  // needs proportionally more of it: halving cpuLimit roughly doubles the
+  // run time of CPU-bound code.
+  cpuLimit?: number;
+  cpuShares?: number;
+  // Per-process rlimits keyed by name (stack, nofile, ...), in the units
+  // setrlimit uses: bytes for stack, a count for nofile. Unlike pidsLimit,
+  // nproc is counted per user across every container on the host.
+  ulimits?: Record<string, Ulimit>;
+  // Caps what the program can write to /workspace and, separately, to /tmp.
+  diskLimitBytes?: number;
+  maxOutputBytes?: number;
+  // Paths under /workspace to return after the run, up to maxOutputFilesBytes
+  // in total.
+  outputFiles?: string[];
+  maxOutputFilesBytes?: number;
+  network?: NetworkMode;
+  readOnlyRootFs?: boolean;
+  // Path to a seccomp profile on the runner host, or DEFAULT_SECCOMP_PROFILE.
+  seccompProfile?: string;
+  // OCI runtime to run under, e.g. runsc for gVisor. Defaults to the
+  // runner's configured runtime, or the daemon default.
+  runtime?: string;
+  signal?: AbortSignal;
+}
+
+export interface ExecutionResult {
+  stdout: string;
+  stderr: string;
+  exitCode: number;
+  // Name of the signal that ended the program (e.g. SIGSEGV), when it died
+  // from one rather than exiting.
+  signal?: string;
+  timedOut: boolean;
+  oomKilled: boolean;
+  outputTruncated: boolean;
+  duration: number;
+  peakMemoryBytes?: number;
+  compileError?: string;
+  // What a successful compile printed, such as warnings, when anything.
+  compileOutput?: string;
+  outputFiles?: Record<string, Buffer>;
+  // Why a requested output file was not returned, keyed by its path.
+  outputFileErrors?: Record<string, string>;
+}
+
+export interface OutputStreams {
+  stdout?: NodeJS.WritableStream;
+  stderr?: NodeJS.WritableStream;
+}
+
+export interface TestCase {
+  stdin: string;
+  expectedStdout: string;
+}
+
+export interface TestCaseOptions {
+  ignoreTrailingWhitespace?: boolean;
+}
+
+export interface TestCaseResult extends ExecutionResult {
+  passed: boolean;
+}
+
+export interface TestRunResult {
+  compileError?: string;
+  compileOutput?: string;
+  cases: TestCaseResult[];
+}
+
+interface SubmissionResult {
   submissionId: string;
   verdict: string;
   score?: number;
@@ -24,176 +176,1477 @@ interface ExecutionResult {
   error?: string;
 }
 
-const LANGUAGE_CONFIG: Record<string, {
+const DEFAULT_PIDS_LIMIT = 128;
+const DEFAULT_CPU_LIMIT = 1;
+const DEFAULT_CPU_SHARES = 512;
+export const DEFAULT_MAX_OUTPUT_BYTES = 1024 * 1024;
+export const DEFAULT_MAX_OUTPUT_FILES_BYTES = 10 * 1024 * 1024;
+const SCRATCH_TMPFS = 'rw,noexec,nosuid,size=50m';
+const DEFAULT_INSTALL_TIMEOUT = 120000;
+const DEFAULT_COMPILE_TIMEOUT = 30000;
+
+const DEFAULT_ENV: Record<string, string> = {
+  LANG: 'C.UTF-8',
+  LC_ALL: 'C.UTF-8',
+  TZ: 'UTC',
+  PYTHONDONTWRITEBYTECODE: '1',
+  NODE_ENV: 'production',
+};
+
+const DETERMINISTIC_ENV: Record<string, string> = {
+  TZ: 'UTC',
+  LANG: 'C.UTF-8',
+  LC_ALL: 'C.UTF-8',
+  SOURCE_DATE_EPOCH: '0',
+};
+
+// Variables that control where binaries, libraries and toolchains are loaded
+// from. Overriding them needs allowUnsafeEnv.
+const PROTECTED_ENV = new Set([
+  'PATH',
+  'HOME',
+  'LD_PRELOAD',
+  'LD_LIBRARY_PATH',
+  'GOPATH',
+  'GOCACHE',
+  'GOMODCACHE',
+  'CARGO_HOME',
+  'RUSTUP_HOME',
+  'JAVA_TOOL_OPTIONS',
+  'NODE_OPTIONS',
+]);
+
+const ENV_NAME = /^[A-Za-z_][A-Za-z0-9_]*$/;
+
+// The container's cgroup is gone by the time the runner sees it exit, so the
+// peak is read from inside: a wrapper shell runs the program, then copies
+// memory.peak (cgroup v2) or memory.max_usage_in_bytes (cgroup v1) into the
+// workspace before exiting with the program's status.
+const PEAK_MEMORY_FILE = '.peak-memory';
+const MEASURE_SCRIPT = [
+  '"$@"',
+  'status=$?',
+  // Whatever the program left under that name is replaced, so a FIFO there
+  // cannot block the wrapper.
+  `rm -rf ${PEAK_MEMORY_FILE}`,
+  'cat /sys/fs/cgroup/memory.peak /sys/fs/cgroup/memory/memory.max_usage_in_bytes' +
+    ` 2>/dev/null | head -n 1 > ${PEAK_MEMORY_FILE}`,
+  'exit $status',
+].join('; ');
+
+const READ_FLAGS = fsConstants.O_RDONLY | fsConstants.O_NOFOLLOW | fsConstants.O_NONBLOCK;
+
+// Opens a file the program may have planted, for reading on the host. A
+// symlink as the last component fails with ELOOP, a FIFO opens without
+// waiting for a writer, and anything but a regular file is closed again and
+// reported as undefined. Reads must go through the handle, not the path.
+const openRegularFile = async (path: string) => {
+  const handle = await open(path, READ_FLAGS);
+
+  let stats;
+  try {
+    stats = await handle.stat();
+  } catch (error) {
+    await handle.close();
+    throw error;
+  }
+
+  if (!stats.isFile()) {
+    await handle.close();
+    return undefined;
+  }
+  return { handle, size: stats.size };
+};
+
+// The wrapper writes the file into the workspace, where the program can also
+// create it first, e.g. as a FIFO or a symlink; see openRegularFile.
+const readPeakMemory = async (workspace: string): Promise<number | undefined> => {
+  const path = join(workspace, PEAK_MEMORY_FILE);
+  let file: Awaited<ReturnType<typeof openRegularFile>>;
+
+  try {
+    file = await openRegularFile(path);
+    if (!file) {
+      return undefined;
+    }
+    const contents = Buffer.alloc(32);
+    const { bytesRead } = await file.handle.read(contents, 0, contents.length, 0);
+    const peak = parseInt(contents.toString('utf-8', 0, bytesRead), 10);
+    return Number.isNaN(peak) ? undefined : peak;
+  } catch (e) {
+    return undefined;
+  } finally {
+    await file?.handle.close();
+    await rm(path, { force: true });
+  }
+};
+
+// Some numbers have aliases listed after the usual name (SIGIOT after
+// SIGABRT, SIGPOLL after SIGIO); the first name wins.
+const SIGNAL_NAMES = new Map<number, string>();
+for (const [name, signum] of Object.entries(constants.signals)) {
+  if (!SIGNAL_NAMES.has(signum)) {
+    SIGNAL_NAMES.set(signum, name);
+  }
+}
+
+// Docker reports a signal death as 128+signum, the same way a shell does, so a
+// program that deliberately exits with such a code is indistinguishable.
+export const exitSignal = (exitCode: number): string | undefined => {
+  return exitCode > 128 ? SIGNAL_NAMES.get(exitCode - 128) : undefined;
+};
+
+// Shared by the stdout and stderr collectors so the cap applies to their
+// combined size. Bytes past the cap are dropped as they arrive.
+export const createOutputLimit = (maxBytes: number, onExceeded: () => void) => {
+  let used = 0;
+  let truncated = false;
+
+  return {
+    take: (size: number): number => {
+      const allowed = Math.max(0, Math.min(size, maxBytes - used));
+      used += allowed;
+      if (allowed < size && !truncated) {
+        truncated = true;
+        onExceeded();
+      }
+      return allowed;
+    },
+    truncated: () => truncated,
+  };
+};
+
+type OutputLimit = ReturnType<typeof createOutputLimit>;
+
+// Buffers output for the final result and, when a sink is given, forwards
+// each demultiplexed chunk to it as soon as it arrives.
+export const createCollector = (limit: OutputLimit, sink?: NodeJS.WritableStream) => {
+  const chunks: Buffer[] = [];
+  const stream = new Writable({
+    write(chunk: Buffer, _encoding, callback) {
+      const allowed = limit.take(chunk.length);
+      if (allowed > 0) {
+        const kept = chunk.subarray(0, allowed);
+        chunks.push(kept);
+        sink?.write(kept);
+      }
+      callback();
+    },
+  });
+
+  return {
+    stream,
+    text: () => Buffer.concat(chunks).toString('utf-8'),
+  };
+};
+
+interface ContainerRun {
+  language: string;
   image: string;
   command: string[];
-  fileName: string;
-  compileCommand?: string[];
-}> = {
-  cpp: {
-    image: 'codecontest/cpp-runner:latest',
-    command: ['/bin/sh', '-c', 'g++ -O2 -std=c++17 -o main main.cpp && ./main'],
-    fileName: 'main.cpp',
-  },
-  java: {
-    image: 'codecontest/java-runner:latest',
-    command: ['/bin/sh', '-c', 'javac Main.java && java Main'],
-    fileName: 'Main.java',
-  },
-  python: {
-    image: 'codecontest/python-runner:latest',
-    command: ['python3', 'main.py'],
-    fileName: 'main.py',
-  },
-  javascript: {
-    image: 'codecontest/nodejs-runner:latest',
-    command: ['node', 'main.js'],
-    fileName: 'main.js',
-  },
-  go: {
-    image: 'codecontest/go-runner:latest',
-    command: ['/bin/sh', '-c', 'go build -o main main.go && ./main'],
-    fileName: 'main.go',
-  },
-  rust: {
-    image: 'codecontest/rust-runner:latest',
-    command: ['/bin/sh', '-c', 'rustc -O -o main main.rs && ./main'],
-    fileName: 'main.rs',
-  },
-};
-
-const SECCOMP_PROFILE = {
-  defaultAction: 'SCMP_ACT_ERRNO',
-  architectures: ['SCMP_ARCH_X86_64', 'SCMP_ARCH_X86', 'SCMP_ARCH_AARCH64'],
-  syscalls: [
-    { names: ['read', 'write', 'open', 'close', 'exit', 'exit_group'], action: 'SCMP_ACT_ALLOW' },
-    { names: ['mmap', 'munmap', 'mprotect', 'brk'], action: 'SCMP_ACT_ALLOW' },
-    { names: ['execve', 'execveat'], action: 'SCMP_ACT_ALLOW' },
-    { names: ['access', 'faccessat'], action: 'SCMP_ACT_ALLOW' },
-    { names: ['stat', 'fstat', 'lstat', 'newfstatat'], action: 'SCMP_ACT_ALLOW' },
-    { names: ['getdents', 'getdents64'], action: 'SCMP_ACT_ALLOW' },
-    { names: ['clock_gettime', 'gettimeofday', 'time'], action: 'SCMP_ACT_ALLOW' },
-    { names: ['arch_prctl', 'set_tid_address', 'set_robust_list'], action: 'SCMP_ACT_ALLOW' },
-    { names: ['prlimit64', 'getrlimit'], action: 'SCMP_ACT_ALLOW' },
-    { names: ['sigaltstack', 'rt_sigaction', 'rt_sigprocmask'], action: 'SCMP_ACT_ALLOW' },
-    { names: ['clone', 'wait4', 'waitpid'], action: 'SCMP_ACT_ALLOW' },
-    { names: ['pipe', 'pipe2', 'dup', 'dup2'], action: 'SCMP_ACT_ALLOW' },
-    { names: ['fcntl', 'ioctl'], action: 'SCMP_ACT_ALLOW' },
-    { names: ['getpid', 'getppid', 'getpgrp', 'getuid', 'getgid'], action: 'SCMP_ACT_ALLOW' },
-    { names: ['pread64', 'pwrite64', 'readv', 'writev'], action: 'SCMP_ACT_ALLOW' },
-    { names: ['lseek'], action: 'SCMP_ACT_ALLOW' },
-    { names: ['uname'], action: 'SCMP_ACT_ALLOW' },
-    { names: ['sysinfo'], action: 'SCMP_ACT_ALLOW' },
-    { names: ['getrandom'], action: 'SCMP_ACT_ALLOW' },
-  ],
-};
+  workspace: string;
+  stdin?: string | Buffer;
+  timeout: number;
+  memoryLimit: number;
+  pidsLimit: number;
+  cpuLimit: number;
+  cpuShares: number;
+  ulimits?: Record<string, Ulimit>;
+  diskLimit?: number;
+  maxOutputBytes: number;
+  network: NetworkMode;
+  readOnlyRootFs: boolean;
+  seccompProfile: string;
+  runtime?: string;
+  user?: string;
+  env: string[];
+  binds: string[];
+  labels: Record<string, string>;
+  measureMemory?: boolean;
+  signal?: AbortSignal;
+  streams?: OutputStreams;
+  log: RunnerLogger;
+}
 
-export const processSubmission = async (
-  docker: Docker,
-  job: SubmissionJob,
+type SandboxSettings = Pick<
+  ContainerRun,
+  | 'workspace'
+  | 'binds'
+  | 'memoryLimit'
+  | 'pidsLimit'
+  | 'cpuLimit'
+  | 'cpuShares'
+  | 'ulimits'
+  | 'diskLimit'
+  | 'network'
+  | 'readOnlyRootFs'
+  | 'seccompProfile'
+  | 'runtime'
+>;
+
+export const defaultSandbox = async (
   config: RunnerConfig
-): Promise<ExecutionResult> => {
-  const langConfig = LANGUAGE_CONFIG[job.language];
-  
-  if (!langConfig) {
-    return {
-      submissionId: job.submissionId,
-      verdict: 'SYSTEM_ERROR',
-      error: `Unsupported language: ${job.language}`,
-    };
+): Promise<Omit<SandboxSettings, 'workspace' | 'binds'>> => {
+  return {
+    memoryLimit: config.maxMemory,
+    pidsLimit: DEFAULT_PIDS_LIMIT,
+    cpuLimit: DEFAULT_CPU_LIMIT,
+    cpuShares: DEFAULT_CPU_SHARES,
+    network: 'none',
+    readOnlyRootFs: true,
+    seccompProfile: await resolveSeccompProfile(),
+    runtime: config.runtime,
+  };
+};
+
+const knownRuntimes = new Set<string>();
+
+// Fails with a readable message when the daemon has no such runtime instead of
+// leaving it to container creation. Runtimes can be added by reconfiguring the
+// daemon, so only ones that were found are remembered.
+export const checkRuntime = async (docker: DockerClient, runtime: string): Promise<void> => {
+  if (knownRuntimes.has(runtime)) {
+    return;
+  }
+
+  const info = await docker.info();
+  const available = Object.keys(info.Runtimes ?? {});
+
+  if (!available.includes(runtime)) {
+    throw new InvalidRequestError(
+      `Container runtime ${runtime} is not available (daemon has: ${available.join(', ') || 'none'})`
+    );
   }
 
-  const containerName = `submission-${job.submissionId}`;
-  const codeHash = hashCode(job.code);
-  
+  knownRuntimes.add(runtime);
+};
+
+export const sandboxHostConfig = (run: SandboxSettings): Docker.HostConfig => {
+  return {
+    // Equal memory and memory+swap limits leave the program no swap.
+    Memory: run.memoryLimit,
+    MemorySwap: run.memoryLimit,
+    NanoCpus: Math.round(run.cpuLimit * 1e9),
+    CpuShares: run.cpuShares,
+    // Hitting the limit makes fork/clone fail with EAGAIN inside the
+    // container; the run still ends through exit or the timeout.
+    PidsLimit: run.pidsLimit,
+    Ulimits: Object.entries(run.ulimits ?? {}).map(([name, limit]) => ({
+      Name: name,
+      Soft: limit.soft,
+      Hard: limit.hard,
+    })),
+    NetworkMode: run.network,
+    // With a read-only root the only writable paths are the per-run
+    // workspace bind mount and the size-capped /tmp tmpfs.
+    ReadonlyRootfs: run.readOnlyRootFs,
+    Runtime: run.runtime,
+    SecurityOpt: [
+      'no-new-privileges:true',
+      `seccomp=${run.seccompProfile}`,
+    ],
+    CapDrop: ['ALL'],
+    CapAdd: ['CHOWN', 'SETGID', 'SETUID'],
+    // With a disk limit workspace names the run's size-capped volume rather
+    // than a host directory; see withDiskVolume.
+    Binds: [`${run.workspace}:/workspace:rw`, ...run.binds],
+    Tmpfs: {
+      '/tmp': run.diskLimit ? `rw,noexec,nosuid,size=${run.diskLimit}` : SCRATCH_TMPFS,
+    },
+  };
+};
+
+const containerCommand = (run: ContainerRun): string[] => {
+  return run.measureMemory
+    ? ['/bin/sh', '-c', MEASURE_SCRIPT, 'sh', ...run.command]
+    : run.command;
+};
+
+const createStepContainer = async (
+  docker: DockerClient,
+  run: ContainerRun,
+  options: Pick<Docker.ContainerCreateOptions, 'Cmd' | 'HostConfig' | 'Env'>
+): Promise<Docker.Container> => {
   try {
-    const container = await docker.createContainer({
-      Image: langConfig.image,
-      name: containerName,
-      Cmd: langConfig.command,
-      HostConfig: {
-        Memory: config.maxMemory,
-        MemorySwap: config.maxMemory,
-        CpuQuota: 100000,
-        CpuPeriod: 100000,
-        CpuShares: 512,
-        PidsLimit: 32,
-        NetworkMode: config.networkDisabled ? 'none' : 'bridge',
-        ReadonlyRootfs: true,
-        SecurityOpt: [
-          'no-new-privileges:true',
-          `seccomp=${JSON.stringify(SECCOMP_PROFILE)}`,
-        ],
-        CapDrop: ['ALL'],
-        CapAdd: ['CHOWN', 'SETGID', 'SETUID'],
-        Tmpfs: {
-          '/tmp': 'rw,noexec,nosuid,size=50m',
-        },
-      },
-      Env: [
-        'LANG=C.UTF-8',
-        'LC_ALL=C.UTF-8',
-        'TZ=UTC',
-        'PYTHONDONTWRITEBYTECODE=1',
-        'NODE_ENV=production',
-      ],
+    return await docker.createContainer({
+      ...options,
+      Image: run.image,
+      Labels: run.labels,
+      User: run.user,
       WorkingDir: '/workspace',
+      AttachStdin: true,
       AttachStdout: true,
       AttachStderr: true,
+      OpenStdin: true,
+      StdinOnce: true,
+    });
+  } catch (error) {
+    // The image can disappear after it was last seen, e.g. removed by hand
+    // or by a prune on the same daemon.
+    if (isImageNotFound(error)) {
+      throw new ImageNotBuiltError(run.language, run.image);
+    }
+    throw error;
+  }
+};
+
+// Runs the command of one step in a fresh container with workspace, a host
+// directory or a volume name, mounted at /workspace. The container is
+// SIGKILLed once the timeout elapses or the signal aborts.
+const runStep = async (
+  docker: DockerClient,
+  run: ContainerRun,
+  workspace: string
+): Promise<ExecutionResult> => {
+  let container: Docker.Container | undefined;
+  let timer: NodeJS.Timeout | undefined;
+  let onAbort: (() => void) | undefined;
+
+  try {
+    // No AutoRemove here: the exit state is inspected after wait, so the
+    // container is force-removed in the finally block instead. Anything a
+    // crash leaves behind is found by its labels in Runner.cleanup().
+    container = await createStepContainer(docker, run, {
+      Cmd: containerCommand(run),
+      HostConfig: sandboxHostConfig({ ...run, workspace }),
+      Env: run.env,
+    });
+
+    const running = container;
+    run.log.debug('Container created', {
+      containerId: running.id,
+      language: run.language,
+      image: run.image,
+    });
+
+    const kill = async (reason: string) => {
+      run.log.info('Killing container', { containerId: running.id, reason });
+      try {
+        await running.kill({ signal: 'SIGKILL' });
+      } catch (e) {}
+    };
+
+    const outputLimit = createOutputLimit(run.maxOutputBytes, () => kill('output limit'));
+    const stdout = createCollector(outputLimit, run.streams?.stdout);
+    const stderr = createCollector(outputLimit, run.streams?.stderr);
+
+    const stream = await container.attach({
+      stream: true,
+      stdin: true,
+      stdout: true,
+      stderr: true,
+      hijack: true,
     });
+    docker.modem.demuxStream(stream, stdout.stream, stderr.stream);
 
-    const codeBuffer = Buffer.from(job.code);
-    await container.putArchive(codeBuffer, {
-      path: '/workspace',
+    const streamClosed = new Promise<void>((resolve) => {
+      stream.on('end', resolve);
+      stream.on('close', resolve);
+      stream.on('error', () => resolve());
     });
 
+    let timedOut = false;
+    const expire = (reason: string) => {
+      timedOut = true;
+      kill(reason);
+    };
+
     const startTime = Date.now();
     await container.start();
 
-    const stream = await container.logs({
-      follow: true,
+    timer = setTimeout(() => expire('timeout'), run.timeout);
+    onAbort = () => {
+      clearTimeout(timer);
+      expire('aborted');
+    };
+    run.signal?.addEventListener('abort', onAbort, { once: true });
+    if (run.signal?.aborted) {
+      onAbort();
+    }
+
+    // Ending the write side delivers EOF to the program. A program that exits
+    // without reading all of its input closes the pipe early; that EPIPE is
+    // expected and is not an execution failure.
+    stream.end(run.stdin ?? '');
+
+    await container.wait();
+    clearTimeout(timer);
+    const duration = Date.now() - startTime;
+
+    await streamClosed;
+
+    const info = await container.inspect();
+
+    return {
+      stdout: stdout.text(),
+      stderr: stderr.text(),
+      exitCode: info.State.ExitCode,
+      signal: exitSignal(info.State.ExitCode),
+      timedOut,
+      oomKilled: info.State.OOMKilled,
+      outputTruncated: outputLimit.truncated(),
+      duration,
+    };
+  } finally {
+    clearTimeout(timer);
+    if (onAbort) {
+      run.signal?.removeEventListener('abort', onAbort);
+    }
+    if (container) {
+      try {
+        await container.remove({ force: true });
+      } catch (e) {}
+    }
+  }
+};
+
+const COPY_TIMEOUT = 60000;
+
+// Runs in the copier container, which never runs submitted code: copies the
+// host workspace onto the volume, reports ready, and once released through
+// stdin copies the volume back.
+const COPIER_SCRIPT = [
+  "cp -a /host/. /workspace/ || { echo 'Sources exceed the disk limit' >&2; exit 125; }",
+  'echo ready',
+  'read -r _',
+  'cp -a /workspace/. /host/ 2>/dev/null',
+  'exit 0',
+].join('; ');
+
+// With a disk limit, the step's /workspace is a local tmpfs volume of that
+// size and the step has no host directory it can write to. Writes past the
+// limit fail with ENOSPC inside the container. A copier container moves the
+// files between the host workspace and the volume before and after the step,
+// and keeps the volume mounted in between, since a tmpfs volume is emptied
+// once no container uses it. As that copy is bounded by the volume, so is the
+// host disk a step can use.
+const withDiskVolume = async (
+  docker: DockerClient,
+  run: ContainerRun & { diskLimit: number },
+  step: (volume: string) => Promise<ExecutionResult>
+): Promise<ExecutionResult> => {
+  const volume = `codecontest-disk-${randomUUID()}`;
+  await docker.createVolume({
+    Name: volume,
+    Labels: run.labels,
+    DriverOpts: { type: 'tmpfs', device: 'tmpfs', o: `size=${run.diskLimit},mode=1777,nosuid` },
+  });
+
+  let copier: Docker.Container | undefined;
+  let timer: NodeJS.Timeout | undefined;
+  let onAbort: (() => void) | undefined;
+
+  try {
+    copier = await createStepContainer(docker, run, {
+      Cmd: ['/bin/sh', '-c', COPIER_SCRIPT],
+      // Sources written onto the volume are charged to the copier.
+      HostConfig: sandboxHostConfig({
+        ...run,
+        workspace: volume,
+        binds: [`${run.workspace}:/host:rw`],
+        network: 'none',
+        memoryLimit: run.memoryLimit + run.diskLimit,
+      }),
+    });
+
+    const running = copier;
+    let timedOut = false;
+    const expire = () => {
+      timedOut = true;
+      running.kill({ signal: 'SIGKILL' }).catch(() => {});
+    };
+    onAbort = expire;
+    run.signal?.addEventListener('abort', onAbort, { once: true });
+
+    let ready = () => {};
+    const copiedIn = new Promise<void>((resolve) => {
+      ready = resolve;
+    });
+    let stdout = '';
+    const stderr = createCollector(createOutputLimit(DEFAULT_MAX_OUTPUT_BYTES, () => {}));
+
+    const stream = await copier.attach({
+      stream: true,
+      stdin: true,
       stdout: true,
       stderr: true,
+      hijack: true,
     });
+    docker.modem.demuxStream(
+      stream,
+      new Writable({
+        write(chunk: Buffer, _encoding, callback) {
+          stdout += chunk.toString('utf-8');
+          if (stdout.includes('ready\n')) {
+            ready();
+          }
+          callback();
+        },
+      }),
+      stderr.stream
+    );
 
-    let output = '';
-    let errorOutput = '';
+    const startTime = Date.now();
+    await copier.start();
+    const exited = copier.wait();
+    timer = setTimeout(expire, COPY_TIMEOUT);
 
-    stream.on('data', (chunk: Buffer) => {
-      const text = chunk.toString('utf-8');
-      if (chunk[0] === 1) {
-        output += text.slice(8);
-      } else if (chunk[0] === 2) {
-        errorOutput += text.slice(8);
-      }
-    });
+    const copyFailed = await Promise.race([copiedIn.then(() => undefined), exited]);
+    clearTimeout(timer);
 
-    const timeout = setTimeout(async () => {
+    if (copyFailed) {
+      const exitCode: number = copyFailed.StatusCode ?? 137;
+      return {
+        stdout: '',
+        stderr: stderr.text(),
+        exitCode,
+        signal: exitSignal(exitCode),
+        timedOut,
+        oomKilled: false,
+        outputTruncated: false,
+        duration: Date.now() - startTime,
+      };
+    }
+
+    // The step handles the signal itself from here on.
+    run.signal?.removeEventListener('abort', onAbort);
+    const result = await step(volume);
+
+    timer = setTimeout(expire, COPY_TIMEOUT);
+    stream.end('\n');
+    await exited;
+    return result;
+  } finally {
+    clearTimeout(timer);
+    if (onAbort) {
+      run.signal?.removeEventListener('abort', onAbort);
+    }
+    if (copier) {
       try {
-        await container.kill({ signal: 'SIGKILL' });
-        logger.warn(`Submission ${job.submissionId} killed due to timeout`);
+        await copier.remove({ force: true });
       } catch (e) {}
-    }, job.timeLimit + 2000);
+    }
+    try {
+      await docker.getVolume(volume).remove();
+    } catch (e) {}
+  }
+};
+
+const runContainer = async (
+  docker: DockerClient,
+  run: ContainerRun
+): Promise<ExecutionResult> => {
+  const { diskLimit } = run;
+  const result = diskLimit
+    ? await withDiskVolume(docker, { ...run, diskLimit }, (volume) =>
+        runStep(docker, run, volume)
+      )
+    : await runStep(docker, run, run.workspace);
+
+  if (!run.measureMemory) {
+    return result;
+  }
+  return { ...result, peakMemoryBytes: await readPeakMemory(run.workspace) };
+};
+
+// Only plain relative paths that stay inside the workspace are accepted.
+const validatePath = (name: string): string => {
+  const normalized = posix.normalize(name);
+
+  if (
+    !name ||
+    name.includes('\\') ||
+    name.includes('\0') ||
+    posix.isAbsolute(name) ||
+    normalized === '.' ||
+    normalized === '..' ||
+    normalized.startsWith('../')
+  ) {
+    throw new InvalidRequestError(`Invalid file path: ${name}`);
+  }
+
+  return normalized;
+};
+
+const envList = (env: Record<string, string>): string[] =>
+  Object.entries(env).map(([name, value]) => `${name}=${value}`);
+
+// Precedence, lowest first: the image's ENV (PATH, HOME, GOPATH, ...), the
+// runner defaults above, then request.env.
+export const buildEnv = (request: ExecutionRequest): string[] => {
+  const env = { ...DEFAULT_ENV };
+  const language = request.language ? getLanguage(request.language, request.version) : undefined;
+  const pinned: Record<string, string> = request.deterministic
+    ? { ...DETERMINISTIC_ENV, ...language?.deterministicEnv }
+    : {};
+
+  for (const [name, value] of Object.entries(request.env ?? {})) {
+    if (!ENV_NAME.test(name) || value.includes('\0')) {
+      throw new InvalidRequestError(`Invalid environment variable: ${name}`);
+    }
+    if (PROTECTED_ENV.has(name) && !request.allowUnsafeEnv) {
+      throw new InvalidRequestError(`Environment variable ${name} cannot be overridden`);
+    }
+    if (name in pinned) {
+      throw new InvalidRequestError(`Environment variable ${name} is fixed in deterministic mode`);
+    }
+    env[name] = value;
+  }
+
+  return envList({ ...env, ...pinned });
+};
+
+export const collectFiles = (
+  request: ExecutionRequest,
+  fileName: string
+): Record<string, string> => {
+  const files: Record<string, string> = {};
+
+  if (request.code !== undefined) {
+    files[fileName] = request.code;
+  }
+  Object.assign(files, request.files);
+
+  if (Object.keys(files).length === 0) {
+    throw new InvalidRequestError('Request has no source code');
+  }
+
+  return files;
+};
+
+export const writeWorkspace = async (
+  workspace: string,
+  files: Record<string, string>
+): Promise<void> => {
+  for (const [name, contents] of Object.entries(files)) {
+    const path = join(workspace, validatePath(name));
+    await mkdir(dirname(path), { recursive: true, mode: 0o777 });
+    await writeFile(path, contents);
+  }
+};
+
+// Output files are read from the host workspace once nothing in the container
+// can write to it any more: after the container is gone, or for the pool after
+// every process in it was killed. Symlinks are refused since the program could
+// point them anywhere on the host. Only the last component is opened without
+// following links, so the directory holding it is resolved first and must be
+// inside the workspace.
+export const collectOutputFiles = async (
+  workspace: string,
+  paths: string[],
+  maxBytes: number
+): Promise<Pick<ExecutionResult, 'outputFiles' | 'outputFileErrors'>> => {
+  const outputFiles: Record<string, Buffer> = {};
+  const outputFileErrors: Record<string, string> = {};
+  const root = await realpath(workspace);
+  let total = 0;
+
+  for (const name of paths) {
+    const path = join(workspace, validatePath(name));
+    let file: Awaited<ReturnType<typeof openRegularFile>>;
+
+    try {
+      const dir = await realpath(dirname(path));
+      if (dir !== root && !dir.startsWith(root + sep)) {
+        outputFileErrors[name] = 'not a regular file';
+        continue;
+      }
+
+      file = await openRegularFile(join(dir, basename(path)));
+      if (!file) {
+        outputFileErrors[name] = 'not a regular file';
+        continue;
+      }
+      if (total + file.size > maxBytes) {
+        outputFileErrors[name] = `exceeds the ${maxBytes} byte output file limit`;
+        continue;
+      }
+
+      const contents = Buffer.alloc(file.size);
+      const { bytesRead } = await file.handle.read(contents, 0, file.size, 0);
+      outputFiles[name] = contents.subarray(0, bytesRead);
+      total += bytesRead;
+    } catch (error) {
+      const { code } = error as NodeJS.ErrnoException;
+      outputFileErrors[name] =
+        code === 'ENOENT' ? 'not found' : code === 'ELOOP' ? 'not a regular file' : 'unreadable';
+    } finally {
+      await file?.handle.close();
+    }
+  }
+
+  return {
+    outputFiles,
+    outputFileErrors: Object.keys(outputFileErrors).length ? outputFileErrors : undefined,
+  };
+};
+
+type RunBase = Omit<ContainerRun, 'command' | 'stdin' | 'streams'>;
+
+interface PreparedRun {
+  language: Language;
+  workspace: string;
+  base: RunBase;
+  runCommand: string[];
+  // The language's cache volume, when enabled; see buildBase.
+  buildCacheVolume?: string;
+}
+
+const validateDependency = (spec: string, support: DependencySupport): void => {
+  if (
+    !spec ||
+    spec.startsWith('-') ||
+    /[\s\0]/.test(spec) ||
+    (support.specPattern && !support.specPattern.test(spec))
+  ) {
+    throw new InvalidRequestError(`Invalid dependency: ${spec}`);
+  }
+};
+
+const ULIMIT_NAMES = new Set([
+  'core',
+  'cpu',
+  'data',
+  'fsize',
+  'locks',
+  'memlock',
+  'msgqueue',
+  'nice',
+  'nofile',
+  'nproc',
+  'rss',
+  'rtprio',
+  'rttime',
+  'sigpending',
+  'stack',
+]);
+
+const validateUlimit = (name: string, limit: Ulimit): void => {
+  if (!ULIMIT_NAMES.has(name)) {
+    throw new InvalidRequestError(`Unknown ulimit: ${name}`);
+  }
+  if (
+    !Number.isInteger(limit.soft) ||
+    !Number.isInteger(limit.hard) ||
+    limit.soft < 0 ||
+    limit.soft > limit.hard
+  ) {
+    throw new InvalidRequestError(`Invalid ulimit ${name}: soft ${limit.soft}, hard ${limit.hard}`);
+  }
+};
+
+const USER_SPEC = /^[A-Za-z0-9_][A-Za-z0-9_.-]*(?::[A-Za-z0-9_][A-Za-z0-9_.-]*)?$/;
+
+const isRoot = (name: string): boolean => name === 'root' || /^0+$/.test(name);
+
+const validateUser = (request: ExecutionRequest): void => {
+  if (request.user === undefined) {
+    return;
+  }
+  if (!USER_SPEC.test(request.user)) {
+    throw new InvalidRequestError(`Invalid user: ${request.user}`);
+  }
+  if (request.user.split(':').some(isRoot) && !request.allowRootUser) {
+    throw new InvalidRequestError('Running as root requires allowRootUser');
+  }
+};
+
+// Docker refuses memory limits below 6 MiB.
+const MIN_MEMORY_LIMIT = 6 * 1024 * 1024;
+
+const checkLimit = (name: string, value: number | undefined, min: number, max = Infinity) => {
+  if (value !== undefined && !(value >= min && value <= max)) {
+    throw new InvalidRequestError(
+      `Invalid ${name}: ${value} (allowed: ${min}${max === Infinity ? ' or more' : `..${max}`})`
+    );
+  }
+};
+
+const checkInteger = (name: string, value: number | undefined, min: number, max = Infinity) => {
+  if (value !== undefined && !Number.isInteger(value)) {
+    throw new InvalidRequestError(`Invalid ${name}: ${value} (must be an integer)`);
+  }
+  checkLimit(name, value, min, max);
+};
+
+interface ValidatedRequest {
+  language: Language;
+  entryPoint: EntryPoint;
+  files: Record<string, string>;
+  env: string[];
+  network: NetworkMode;
+  seccompProfile: string;
+  runtime?: string;
+}
+
+// A request whose language is known, as withLanguage() returns it.
+type ResolvedRequest = ExecutionRequest & { language: string };
+
+// Fills in request.language from request.fileName when it was left out.
+const withLanguage = (request: ExecutionRequest): ResolvedRequest => {
+  const language =
+    request.language || (request.fileName ? detectLanguage(request.fileName) : undefined);
+  if (!language) {
+    throw new InvalidRequestError(
+      request.fileName
+        ? `Cannot detect the language of ${request.fileName}`
+        : 'Request has no language or file name'
+    );
+  }
+
+  return { ...request, language };
+};
+
+// Runs before anything else looks at the source, so an oversized submission
+// is turned away without parsing it or touching Docker.
+const checkSourceSize = (
+  request: ExecutionRequest,
+  language: Language,
+  config: RunnerConfig
+): void => {
+  const sources: Array<[string, string]> = Object.entries(request.files ?? {});
+  if (request.code !== undefined) {
+    sources.unshift([language.fileName, request.code]);
+  }
+
+  let total = 0;
+  for (const [file, content] of sources) {
+    const size = Buffer.byteLength(content);
+    if (size > config.maxSourceFileBytes) {
+      throw new SourceTooLargeError(size, config.maxSourceFileBytes, file);
+    }
+    total += size;
+  }
+
+  if (total > config.maxSourceBytes) {
+    throw new SourceTooLargeError(total, config.maxSourceBytes);
+  }
+};
+
+// Everything that can be checked without creating a container. Throws the
+// same errors a run would fail with.
+const validateRequest = async (
+  docker: DockerClient,
+  request: ResolvedRequest,
+  config: RunnerConfig
+): Promise<ValidatedRequest> => {
+  if (!getLanguage(request.language)) {
+    throw new UnknownLanguageError(request.language, undefined, listLanguages());
+  }
+
+  const language = getLanguage(request.language, request.version);
+
+  if (!language) {
+    throw new UnknownLanguageError(
+      request.language,
+      request.version,
+      listVersions(request.language)
+    );
+  }
+
+  checkSourceSize(request, language, config);
+  checkInteger('timeout', request.timeout, 1, config.maxExecutionTime);
+  checkInteger('installTimeout', request.installTimeout, 1);
+  checkInteger('compileTimeout', request.compileTimeout, 1);
+  checkInteger('memoryLimitBytes', request.memoryLimitBytes, MIN_MEMORY_LIMIT, config.maxMemory);
+  checkInteger('pidsLimit', request.pidsLimit, 1);
+  checkLimit('cpuLimit', request.cpuLimit, 0.01);
+  checkInteger('cpuShares', request.cpuShares, 2);
+  checkInteger('diskLimitBytes', request.diskLimitBytes, 1);
+  Object.entries(request.ulimits ?? {}).forEach(([name, limit]) => validateUlimit(name, limit));
+  checkInteger('maxOutputBytes', request.maxOutputBytes, 1);
+  checkInteger('maxOutputFilesBytes', request.maxOutputFilesBytes, 1);
+
+  // Submissions get no network unless the request opts in and the runner
+  // has not been configured to forbid it.
+  const network = request.network ?? 'none';
+  if (network === 'bridge' && config.networkDisabled) {
+    throw new InvalidRequestError('Network access is disabled on this runner');
+  }
+
+  validateUser(request);
+
+  if (request.dependencies?.length) {
+    if (!language.dependencies) {
+      throw new InvalidRequestError(`Language ${request.language} does not support dependencies`);
+    }
+    // Installing them needs the network, even for a run that has none.
+    if (config.networkDisabled) {
+      throw new InvalidRequestError(
+        'Dependencies need network access, which is disabled on this runner'
+      );
+    }
+    const support = language.dependencies;
+    request.dependencies.forEach((spec) => validateDependency(spec, support));
+  }
+
+  const entryPoint = resolveEntryPoint(language, request.code);
+  const files = collectFiles(request, entryPoint.fileName);
+  Object.keys(files).forEach(validatePath);
+  request.outputFiles?.forEach(validatePath);
+  const env = buildEnv(request);
+  const seccompProfile = await resolveSeccompProfile(request.seccompProfile);
+  const runtime = request.runtime ?? config.runtime;
+
+  if (runtime) {
+    await checkRuntime(docker, runtime);
+  }
+
+  return { language, entryPoint, files, env, network, seccompProfile, runtime };
+};
+
+// Checks a request without running it: the checks above, plus that the image
+// is present or, with auto-build enabled, can be built from its Dockerfile.
+export const validate = async (
+  docker: DockerClient,
+  request: ExecutionRequest,
+  config: RunnerConfig
+): Promise<void> => {
+  const resolved = withLanguage(request);
+  const { language } = await validateRequest(docker, resolved, config);
+
+  if (!(await imageAvailable(docker, language, config.autoBuildImages))) {
+    throw new ImageNotBuiltError(resolved.language, imageTag(language));
+  }
+};
+
+// Validates the request, makes sure the image exists and writes the sources
+// into a fresh workspace. The caller owns the workspace and must remove it.
+const prepareRun = async (
+  docker: DockerClient,
+  request: ResolvedRequest,
+  config: RunnerConfig,
+  log: RunnerLogger
+): Promise<PreparedRun> => {
+  const { language, entryPoint, files, env, network, seccompProfile, runtime } =
+    await validateRequest(docker, request, config);
+
+  request.signal?.throwIfAborted();
+
+  const image = await ensureImage(
+    docker,
+    request.language,
+    language.version,
+    log,
+    config.autoBuildImages
+  );
+
+  let workspace: string;
+  try {
+    await mkdir(config.workspaceDir, { recursive: true });
+    workspace = await mkdtemp(join(config.workspaceDir, `${config.runnerId}-run-`));
+  } catch (error) {
+    throw new WorkspaceSetupError(error);
+  }
+
+  try {
+    await writeWorkspace(workspace, files);
+    await chmod(workspace, 0o777);
+  } catch (error) {
+    await rm(workspace, { recursive: true, force: true });
+    throw new WorkspaceSetupError(error);
+  }
+
+  return {
+    language,
+    workspace,
+    buildCacheVolume:
+      config.buildCacheVolumes && language.buildCache
+        ? `codecontest-build-cache-${config.runnerId}-${request.language}`
+        : undefined,
+    // Arguments are appended to the argv array, never interpolated into a
+    // shell string, so metacharacters reach the program literally.
+    runCommand: [...entryPoint.runCommand, ...(request.args ?? [])],
+    base: {
+      language: request.language,
+      image,
+      workspace,
+      timeout: request.timeout ?? config.maxExecutionTime,
+      memoryLimit: request.memoryLimitBytes ?? config.maxMemory,
+      pidsLimit: request.pidsLimit ?? DEFAULT_PIDS_LIMIT,
+      cpuLimit: request.cpuLimit ?? DEFAULT_CPU_LIMIT,
+      cpuShares: request.cpuShares ?? DEFAULT_CPU_SHARES,
+      ulimits: request.ulimits,
+      diskLimit: request.diskLimitBytes,
+      maxOutputBytes: request.maxOutputBytes ?? DEFAULT_MAX_OUTPUT_BYTES,
+      network,
+      readOnlyRootFs: request.readOnlyRootFs ?? true,
+      seccompProfile,
+      runtime,
+      user: request.user,
+      env,
+      binds: [],
+      labels: runnerLabels(config),
+      signal: request.signal,
+      log,
+    },
+  };
+};
+
+const failedBuild = (result: ExecutionResult, prefix = ''): ExecutionResult => {
+  return {
+    stdout: '',
+    stderr: '',
+    exitCode: 0,
+    timedOut: false,
+    oomKilled: false,
+    outputTruncated: false,
+    duration: result.duration,
+    compileError: prefix + (result.stderr || result.stdout),
+  };
+};
+
+const buildSucceeded = (result: ExecutionResult): boolean => {
+  return result.exitCode === 0 && !result.timedOut && !result.oomKilled;
+};
+
+// The settings for an install step, which may write the language's cache
+// volume, or for the compile step, which at most reads it: compiling can run
+// code from the submission's dependencies (build scripts, proc macros), and
+// whatever that wrote to the cache would reach every later build. What an
+// install step writes is shared the same way, by every run with the same
+// dependencies, so it gets the runner's defaults and none of request.env: a
+// package registry or mirror set there would otherwise serve everyone.
+const buildBase = (prepared: PreparedRun, step: 'install' | 'compile'): RunBase => {
+  const cache = prepared.language.buildCache;
+  const volume = prepared.buildCacheVolume;
+  const base =
+    step === 'install' ? { ...prepared.base, env: envList(DEFAULT_ENV) } : prepared.base;
+
+  if (!cache || !volume || (step === 'compile' && !cache.readInCompile)) {
+    return base;
+  }
+  const mode = step === 'install' ? 'rw' : 'ro';
+  return {
+    ...base,
+    binds: [...base.binds, `${volume}:${cache.path}:${mode}`],
+    env: [...base.env, ...envList(cache.env)],
+  };
+};
+
+const cacheLocks = new Map<string, Promise<void>>();
+
+// Runs fn once every earlier holder of the same volume is done. Volumes are
+// named per runner, so holding the lock in this process is enough to keep
+// two install steps from writing one cache at the same time. The toolchains
+// themselves cope with a compile reading while another run writes.
+const withCacheLock = async <T>(volume: string, fn: () => Promise<T>): Promise<T> => {
+  const previous = cacheLocks.get(volume) ?? Promise.resolve();
+  let release = () => {};
+  const held = new Promise<void>((resolve) => {
+    release = resolve;
+  });
+  const queue = previous.then(() => held);
+  cacheLocks.set(volume, queue);
+
+  await previous;
+  try {
+    return await fn();
+  } finally {
+    release();
+    if (cacheLocks.get(volume) === queue) {
+      cacheLocks.delete(volume);
+    }
+  }
+};
+
+const pendingInstalls = new Map<string, Promise<ExecutionResult | undefined>>();
+
+const installInto = async (
+  docker: DockerClient,
+  prepared: PreparedRun,
+  request: ExecutionRequest,
+  config: RunnerConfig,
+  command: string[],
+  cacheDir: string
+): Promise<ExecutionResult | undefined> => {
+  const staging = await mkdtemp(join(dirname(cacheDir), `${config.runnerId}-install-`));
+
+  try {
+    await chmod(staging, 0o777);
+
+    // Installing reaches the network, which is why validateRequest refuses
+    // dependencies on a runner without it. npm runs with package scripts
+    // disabled and cargo vendor only downloads, but bundler builds native
+    // extensions by running the gem's extconf.rb: code from the listed gems,
+    // never from the submission, in the same sandbox as the program. The
+    // program itself still runs with request.network.
+    const installed = await runContainer(docker, {
+      ...buildBase(prepared, 'install'),
+      workspace: staging,
+      network: 'bridge',
+      diskLimit: undefined,
+      timeout: request.installTimeout ?? DEFAULT_INSTALL_TIMEOUT,
+      memoryLimit: config.maxMemory,
+      command,
+    });
+
+    if (!buildSucceeded(installed)) {
+      return failedBuild(installed, 'Dependency installation failed:\n');
+    }
+
+    try {
+      await rename(staging, cacheDir);
+    } catch (e) {
+      // Another runner process finished the same set first.
+    }
+    return undefined;
+  } finally {
+    await rm(staging, { recursive: true, force: true });
+  }
+};
 
-    const result = await container.wait();
-    clearTimeout(timeout);
+// Installed packages are cached on the host per language, image and sorted
+// dependency set, then mounted read-only into the workspace, so repeated runs
+// with the same dependencies skip the install.
+const install = async (
+  docker: DockerClient,
+  prepared: PreparedRun,
+  request: ResolvedRequest,
+  config: RunnerConfig
+): Promise<ExecutionResult | undefined> => {
+  const support = prepared.language.dependencies;
+  const packages = [...new Set(request.dependencies ?? [])].sort();
+
+  // Support and package names were checked by validateRequest.
+  if (packages.length === 0 || !support) {
+    return undefined;
+  }
+
+  const key = hashCode(JSON.stringify([request.language, prepared.base.image, packages]));
+  const cacheDir = join(config.workspaceDir, 'deps', `${request.language}-${key.slice(0, 16)}`);
+
+  let ready = true;
+  try {
+    await access(cacheDir);
+  } catch (e) {
+    ready = false;
+  }
 
-    const executionTime = Date.now() - startTime;
-    
-    const stats = await container.stats({ stream: false });
-    const memoryUsed = stats.memory_stats?.usage || 0;
+  if (!ready) {
+    await mkdir(dirname(cacheDir), { recursive: true });
+
+    let pending = pendingInstalls.get(cacheDir);
+    if (!pending) {
+      pending = installInto(
+        docker,
+        prepared,
+        request,
+        config,
+        support.installCommand(packages),
+        cacheDir
+      );
+      pendingInstalls.set(cacheDir, pending);
+    }
+
+    let failed: ExecutionResult | undefined;
+    try {
+      failed = await pending;
+    } finally {
+      pendingInstalls.delete(cacheDir);
+    }
+    if (failed) {
+      return failed;
+    }
+  }
+
+  prepared.base.binds.push(
+    `${join(cacheDir, support.directory)}:/workspace/${support.directory}:ro`
+  );
+  return undefined;
+};
+
+// Runs the language's fetch command, if the cache volume is in use and the
+// runner allows network access, on the workspace itself and in the same
+// sandbox as an install, without the request's env, so that compiling
+// finds everything the sources import in the cache. Without it only what is
+// already there can be used.
+const fetchImports = async (
+  docker: DockerClient,
+  prepared: PreparedRun,
+  request: ExecutionRequest,
+  config: RunnerConfig
+): Promise<ExecutionResult | undefined> => {
+  const command = prepared.language.buildCache?.fetchCommand;
+  if (!command || !prepared.buildCacheVolume || config.networkDisabled) {
+    return undefined;
+  }
+
+  const fetched = await runContainer(docker, {
+    ...buildBase(prepared, 'install'),
+    network: 'bridge',
+    diskLimit: undefined,
+    timeout: request.installTimeout ?? DEFAULT_INSTALL_TIMEOUT,
+    memoryLimit: config.maxMemory,
+    command,
+  });
+  return buildSucceeded(fetched) ? undefined : failedBuild(fetched, 'Fetching imports failed:\n');
+};
+
+// What the build steps came to: the result to report when one of them
+// failed, otherwise what compiling printed, if anything.
+interface BuildOutcome {
+  failed?: ExecutionResult;
+  compileOutput?: string;
+}
+
+// Runs the language's compile step, if any.
+const compile = async (
+  docker: DockerClient,
+  prepared: PreparedRun,
+  request: ExecutionRequest
+): Promise<BuildOutcome> => {
+  if (!prepared.language.compileCommand) {
+    return {};
+  }
 
-    await container.remove({ force: true });
+  const timeout = request.compileTimeout ?? DEFAULT_COMPILE_TIMEOUT;
+  const compiled = await runContainer(docker, {
+    ...buildBase(prepared, 'compile'),
+    command: prepared.language.compileCommand,
+    timeout,
+  });
+
+  if (compiled.timedOut) {
+    return { failed: failedBuild(compiled, `Compilation timed out after ${timeout}ms\n`) };
+  }
+  if (!buildSucceeded(compiled)) {
+    return { failed: failedBuild(compiled) };
+  }
+  const output = compiled.stderr || compiled.stdout;
+  return output ? { compileOutput: output } : {};
+};
+
+const build = async (
+  docker: DockerClient,
+  prepared: PreparedRun,
+  request: ResolvedRequest,
+  config: RunnerConfig
+): Promise<BuildOutcome> => {
+  const prepare = async () =>
+    (await install(docker, prepared, request, config)) ??
+    fetchImports(docker, prepared, request, config);
+
+  const volume = prepared.buildCacheVolume;
+  const failed = volume
+    ? await withCacheLock(volume, () => {
+        // The wait for the lock may have outlasted the caller.
+        request.signal?.throwIfAborted();
+        return prepare();
+      })
+    : await prepare();
+
+  return failed ? { failed } : compile(docker, prepared, request);
+};
+
+// Runs attempt once more when its image turned out to be missing although it
+// was thought ready, so that ensureImage() can rebuild it. A second miss, or
+// one with auto-build off, is left to the caller as ImageNotBuiltError.
+const retryMissingImage = async <T>(
+  config: RunnerConfig,
+  log: RunnerLogger,
+  attempt: () => Promise<T>
+): Promise<T> => {
+  try {
+    return await attempt();
+  } catch (error) {
+    if (
+      !(error instanceof ImageNotBuiltError) ||
+      !config.autoBuildImages ||
+      !forgetImage(error.image)
+    ) {
+      throw error;
+    }
+    log.warn('Image missing, rebuilding', { language: error.language, image: error.image });
+    return attempt();
+  }
+};
+
+const executeOnce = async (
+  docker: DockerClient,
+  request: ResolvedRequest,
+  config: RunnerConfig,
+  log: RunnerLogger,
+  streams?: OutputStreams
+): Promise<ExecutionResult> => {
+  const prepared = await prepareRun(docker, request, config, log);
+
+  try {
+    const { failed, compileOutput } = await build(docker, prepared, request, config);
+    if (failed) {
+      return failed;
+    }
+
+    const ran = await runContainer(docker, {
+      ...prepared.base,
+      command: prepared.runCommand,
+      measureMemory: true,
+      stdin: request.stdin,
+      streams,
+    });
+    const result = compileOutput ? { ...ran, compileOutput } : ran;
+
+    if (!request.outputFiles?.length) {
+      return result;
+    }
+
+    return {
+      ...result,
+      ...(await collectOutputFiles(
+        prepared.workspace,
+        request.outputFiles,
+        request.maxOutputFilesBytes ?? DEFAULT_MAX_OUTPUT_FILES_BYTES
+      )),
+    };
+  } finally {
+    await rm(prepared.workspace, { recursive: true, force: true });
+  }
+};
+
+const executeRequest = async (
+  docker: DockerClient,
+  request: ResolvedRequest,
+  config: RunnerConfig,
+  log: RunnerLogger,
+  streams?: OutputStreams
+): Promise<ExecutionResult> => {
+  return retryMissingImage(config, log, () => executeOnce(docker, request, config, log, streams));
+};
+
+// Throws only for infrastructure failures (daemon unreachable, missing image,
+// workspace I/O). Everything about the user program is reported in the result.
+// Compiled languages build in their own container first; if that fails the
+// run is skipped and the compiler output is returned as compileError. What a
+// compile that succeeds printed, such as warnings, is returned as compileOutput.
+export const execute = (
+  docker: DockerClient,
+  request: ExecutionRequest,
+  config: RunnerConfig,
+  log: RunnerLogger = noopLogger
+): Promise<ExecutionResult> => {
+  return executeRequest(docker, withLanguage(request), config, log);
+};
+
+// Like execute, but also writes the program's stdout and stderr to the given
+// streams while it runs. Compiler output is only reported in compileError or
+// compileOutput. The streams are not ended; the resolved result still holds
+// the full output.
+export const executeStream = (
+  docker: DockerClient,
+  request: ExecutionRequest,
+  config: RunnerConfig,
+  streams: OutputStreams,
+  log: RunnerLogger = noopLogger
+): Promise<ExecutionResult> => {
+  return executeRequest(docker, withLanguage(request), config, log, streams);
+};
+
+const normalizeOutput = (output: string, ignoreTrailingWhitespace: boolean): string => {
+  if (!ignoreTrailingWhitespace) {
+    return output;
+  }
+  return output
+    .split('\n')
+    .map((line) => line.trimEnd())
+    .join('\n')
+    .trimEnd();
+};
+
+const runCasesOnce = async (
+  docker: DockerClient,
+  request: ResolvedRequest,
+  config: RunnerConfig,
+  cases: TestCase[],
+  options: TestCaseOptions,
+  log: RunnerLogger
+): Promise<TestRunResult> => {
+  const prepared = await prepareRun(docker, request, config, log);
+  const ignoreTrailingWhitespace = options.ignoreTrailingWhitespace ?? false;
+
+  try {
+    const { failed, compileOutput } = await build(docker, prepared, request, config);
+    if (failed) {
+      return { compileError: failed.compileError, cases: [] };
+    }
+
+    const results: TestCaseResult[] = [];
+
+    for (const testCase of cases) {
+      const result = await runContainer(docker, {
+        ...prepared.base,
+        command: prepared.runCommand,
+        measureMemory: true,
+        stdin: testCase.stdin,
+      });
+
+      const passed =
+        result.exitCode === 0 &&
+        !result.timedOut &&
+        !result.oomKilled &&
+        !result.outputTruncated &&
+        normalizeOutput(result.stdout, ignoreTrailingWhitespace) ===
+          normalizeOutput(testCase.expectedStdout, ignoreTrailingWhitespace);
+
+      results.push({ ...result, passed });
+    }
+
+    return compileOutput ? { compileOutput, cases: results } : { cases: results };
+  } finally {
+    await rm(prepared.workspace, { recursive: true, force: true });
+  }
+};
+
+// Compiles the submission once and then runs it against every case in order,
+// each in a fresh container sharing the compiled workspace. request.stdin is
+// ignored in favour of each case's stdin.
+export const runTestCases = async (
+  docker: DockerClient,
+  request: ExecutionRequest,
+  config: RunnerConfig,
+  cases: TestCase[],
+  options: TestCaseOptions = {},
+  log: RunnerLogger = noopLogger
+): Promise<TestRunResult> => {
+  const submission = withLanguage(request);
+  return retryMissingImage(config, log, () =>
+    runCasesOnce(docker, submission, config, cases, options, log)
+  );
+};
+
+export const processSubmission = async (
+  runner: Runner,
+  job: SubmissionJob,
+  config: RunnerConfig
+): Promise<SubmissionResult> => {
+  if (!getLanguage(job.language)) {
+    return {
+      submissionId: job.submissionId,
+      verdict: 'SYSTEM_ERROR',
+      error: `Unsupported language: ${job.language}`,
+    };
+  }
+
+  try {
+    const result = await runner.execute({
+      language: job.language,
+      code: job.code,
+      timeout: Math.min(job.timeLimit, config.maxExecutionTime),
+      memoryLimitBytes: Math.min(job.memoryLimit * 1024 * 1024, config.maxMemory),
+    });
 
     let verdict: string;
     let score = 0;
 
-    if (result.StatusCode === 137 || executionTime > job.timeLimit) {
-      verdict = 'TIME_LIMIT_EXCEEDED';
-    } else if (memoryUsed > job.memoryLimit * 1024 * 1024) {
+    if (result.compileError !== undefined) {
+      verdict = 'COMPILATION_ERROR';
+    } else if (result.oomKilled) {
       verdict = 'MEMORY_LIMIT_EXCEEDED';
-    } else if (result.StatusCode !== 0) {
-      if (errorOutput.includes('Compilation error') || errorOutput.includes('SyntaxError')) {
+    } else if (result.outputTruncated) {
+      verdict = 'RUNTIME_ERROR';
+    } else if (result.timedOut || result.exitCode === 137 || result.duration > job.timeLimit) {
+      verdict = 'TIME_LIMIT_EXCEEDED';
+    } else if (result.exitCode !== 0) {
+      if (result.stderr.includes('SyntaxError')) {
         verdict = 'COMPILATION_ERROR';
       } else {
         verdict = 'RUNTIME_ERROR';
@@ -207,20 +1660,15 @@ export const processSubmission = async (
       submissionId: job.submissionId,
       verdict,
       score,
-      executionTime,
-      memoryUsed,
+      executionTime: result.duration,
+      memoryUsed: result.peakMemoryBytes,
       testCasesPassed: verdict === 'ACCEPTED' ? 1 : 0,
       totalTestCases: 1,
-      output: output.slice(0, 10000),
-      error: errorOutput.slice(0, 10000),
+      output: result.stdout.slice(0, 10000),
+      error: (result.compileError ?? result.stderr).slice(0, 10000),
     };
   } catch (error) {
     logger.error(`Execution failed for ${job.submissionId}:`, error);
-    
-    try {
-      const container = docker.getContainer(containerName);
-      await container.remove({ force: true });
-    } catch (e) {}
 
     return {
       submissionId: job.submissionId,
@@ -0,0 +1,235 @@
+import { Readable } from 'stream';
+import { RunnerConfig } from './config.js';
+import { DockerClient } from './docker.js';
+import { hashCode } from './crypto.js';
+import { getLanguage, listLanguages, listVersions, Language } from './languages.js';
+import { logger, noopLogger, RunnerLogger } from './logger.js';
+import { createTar } from './tar.js';
+import {
+  ImageBuildError,
+  ImageNotBuiltError,
+  UnknownLanguageError,
+  isImageNotFound,
+} from './errors.js';
+
+export const OWNER_LABEL = 'created-by';
+export const OWNER_LABEL_VALUE = 'codecontest-runner';
+export const RUNNER_ID_LABEL = 'codecontest.runner-id';
+
+// Containers also carry the runner id so one runner's cleanup never touches
+// containers that belong to another runner on the same daemon.
+export const runnerLabels = (config: RunnerConfig): Record<string, string> => {
+  return {
+    [OWNER_LABEL]: OWNER_LABEL_VALUE,
+    [RUNNER_ID_LABEL]: config.runnerId,
+  };
+};
+
+const readyImages = new Set<string>();
+const pendingBuilds = new Map<string, Promise<void>>();
+
+// Images built from a Dockerfile are tagged with a hash of its contents, so
+// editing the Dockerfile produces a new tag and forces a rebuild.
+export const imageTag = (language: Language): string => {
+  if (!language.dockerfile) {
+    return language.image;
+  }
+  return `${language.image}:${hashCode(language.dockerfile).slice(0, 12)}`;
+};
+
+const imageExists = async (docker: DockerClient, tag: string): Promise<boolean> => {
+  try {
+    await docker.getImage(tag).inspect();
+    return true;
+  } catch (error) {
+    if (isImageNotFound(error)) {
+      return false;
+    }
+    throw error;
+  }
+};
+
+const buildImage = async (
+  docker: DockerClient,
+  name: string,
+  language: Language,
+  tag: string,
+  log: RunnerLogger
+): Promise<void> => {
+  const context = Readable.from([createTar({ Dockerfile: language.dockerfile ?? '' })]);
+  const startTime = Date.now();
+
+  logger.info(`Building image ${tag} for ${name} ${language.version}`);
+  log.info('Image build started', { language: name, version: language.version, image: tag });
+
+  // Build output is kept so a failure can be reported with its log.
+  const stream = await docker.buildImage(context, {
+    t: tag,
+    labels: {
+      [OWNER_LABEL]: OWNER_LABEL_VALUE,
+      language: name,
+      version: language.version,
+    },
+  });
+
+  const built = new Promise<void>((resolve, reject) => {
+    docker.modem.followProgress(
+      stream,
+      (err: Error | null, output: Array<{ stream?: string; error?: string }> = []) => {
+        const buildLog = output.map((event) => event.stream ?? event.error ?? '').join('');
+        if (err) {
+          reject(new ImageBuildError(tag, buildLog, err));
+          return;
+        }
+        const failed = output.find((event) => event.error);
+        if (failed) {
+          reject(new ImageBuildError(tag, buildLog, new Error(failed.error)));
+          return;
+        }
+        resolve();
+      }
+    );
+  });
+
+  try {
+    await built;
+  } catch (error) {
+    log.warn('Image build failed', { language: name, version: language.version, image: tag });
+    throw error;
+  }
+
+  const duration = Date.now() - startTime;
+  logger.info(`Built image ${tag} for ${name} ${language.version} in ${duration}ms`);
+  log.info('Image build finished', { language: name, version: language.version, image: tag, duration });
+};
+
+// True when the image is present or, with autoBuild, can be built from the
+// language's Dockerfile; nothing is built.
+export const imageAvailable = async (
+  docker: DockerClient,
+  language: Language,
+  autoBuild = true
+): Promise<boolean> => {
+  const tag = imageTag(language);
+  return (
+    readyImages.has(tag) ||
+    (autoBuild && !!language.dockerfile) ||
+    (await imageExists(docker, tag))
+  );
+};
+
+// Drops a tag from the ready set after the daemon reported it missing, so the
+// next ensureImage() checks for it again. Returns whether it was known ready.
+export const forgetImage = (tag: string): boolean => {
+  return readyImages.delete(tag);
+};
+
+// Returns the tag to run for a language, building the image first if it is
+// not present. Concurrent callers for the same tag share one build. Without
+// autoBuild a missing image is an ImageNotBuiltError instead.
+export const ensureImage = async (
+  docker: DockerClient,
+  name: string,
+  version?: string,
+  log: RunnerLogger = noopLogger,
+  autoBuild = true
+): Promise<string> => {
+  const language = getLanguage(name, version);
+
+  if (!language) {
+    throw new UnknownLanguageError(
+      name,
+      version,
+      version === undefined ? listLanguages() : listVersions(name)
+    );
+  }
+
+  const tag = imageTag(language);
+
+  if (readyImages.has(tag) || !language.dockerfile) {
+    return tag;
+  }
+
+  let pending = pendingBuilds.get(tag);
+  if (!pending) {
+    pending = (async () => {
+      if (!(await imageExists(docker, tag))) {
+        if (!autoBuild) {
+          throw new ImageNotBuiltError(name, tag);
+        }
+        await buildImage(docker, name, language, tag, log);
+      }
+      readyImages.add(tag);
+    })();
+    pendingBuilds.set(tag, pending);
+  }
+
+  try {
+    await pending;
+  } finally {
+    pendingBuilds.delete(tag);
+  }
+
+  return tag;
+};
+
+// Builds every registered language image up front so the first submission
+// for each language does not pay the build cost. Failures are logged and
+// left to the lazy build in execute().
+export const warmup = async (docker: DockerClient): Promise<void> => {
+  for (const name of listLanguages()) {
+    for (const version of listVersions(name)) {
+      try {
+        await ensureImage(docker, name, version);
+      } catch (error) {
+        logger.error(`Failed to prepare image for ${name} ${version}:`, error);
+      }
+    }
+  }
+};
+
+// Removes all but the newest keepLatest images per language and version among
+// those this runner built. Images that a container still uses, or that the
+// current Dockerfiles map to, are always kept. Returns the removed image ids.
+export const pruneImages = async (docker: DockerClient, keepLatest: number): Promise<string[]> => {
+  const images = await docker.listImages({
+    filters: { label: [`${OWNER_LABEL}=${OWNER_LABEL_VALUE}`] },
+  });
+  const containers = await docker.listContainers({ all: true });
+  const inUse = new Set(containers.map((info) => info.ImageID));
+  const current = new Set(
+    listLanguages().flatMap((name) =>
+      listVersions(name).map((version) => imageTag(getLanguage(name, version)!))
+    )
+  );
+
+  const groups = new Map<string, typeof images>();
+  for (const image of images) {
+    const key = `${image.Labels?.language}:${image.Labels?.version ?? ''}`;
+    groups.set(key, [...(groups.get(key) ?? []), image]);
+  }
+
+  const removed: string[] = [];
+  for (const group of groups.values()) {
+    const stale = group.sort((a, b) => b.Created - a.Created).slice(Math.max(0, keepLatest));
+
+    for (const image of stale) {
+      const tags = image.RepoTags ?? [];
+      if (inUse.has(image.Id) || tags.some((tag) => current.has(tag))) {
+        continue;
+      }
+
+      try {
+        await docker.getImage(image.Id).remove();
+        tags.forEach((tag) => readyImages.delete(tag));
+        removed.push(image.Id);
+        logger.info(`Removed stale image ${tags.join(', ') || image.Id}`);
+      } catch (error) {
+        // A container may have started from it since the listing.
+        logger.warn(`Failed to remove image ${image.Id}:`, error);
+      }
+    }
+  }
+
+  return removed;
+};
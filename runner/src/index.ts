@@ -1,39 +1,47 @@
-import Docker from 'dockerode';
+import { collectDefaultMetrics, Registry } from 'prom-client';
 import { createSigner } from './crypto.js';
 import { logger } from './logger.js';
 import { processSubmission } from './executor.js';
 import { registerRunner, heartbeat } from './registry.js';
 import { loadConfig } from './config.js';
+import { createDockerClient } from './docker.js';
+import { warmup } from './images.js';
+import { createRunner } from './runner.js';
+import { createServer } from './server.js';
 
 const config = loadConfig();
 
-const docker = new Docker({
-  socketPath: config.dockerSocket,
-});
+const docker = createDockerClient(config);
 
 const signer = createSigner(config.privateKey);
 
+const metrics = new Registry();
+collectDefaultMetrics({ register: metrics });
+
+const runner = createRunner(docker, config, { metrics, logger });
+
 const RUNNER_ID = config.runnerId;
 const CONCURRENCY = config.concurrency;
 
-const activeContainers = new Map<string, Docker.Container>();
+// In-flight submissions get up to one full time limit to finish before they
+// are killed.
+const SHUTDOWN_GRACE = config.maxExecutionTime + 5000;
 
-const cleanupContainer = async (containerId: string) => {
-  try {
-    const container = docker.getContainer(containerId);
-    await container.stop({ t: 5 });
-    await container.remove({ force: true });
-    activeContainers.delete(containerId);
-    logger.info(`Container ${containerId} cleaned up`);
-  } catch (error) {
-    logger.error(`Failed to cleanup container ${containerId}:`, error);
-  }
-};
+let shuttingDown = false;
+
+// Submissions being processed, so that shutdown can wait for their results
+// to be posted.
+const jobs = new Set<Promise<void>>();
 
 const cleanupAllContainers = async () => {
-  logger.info('Cleaning up all containers...');
-  for (const [id, container] of activeContainers) {
-    await cleanupContainer(id);
+  shuttingDown = true;
+  logger.info('Draining in-flight runs and cleaning up containers...');
+  try {
+    await runner.shutdown(AbortSignal.timeout(SHUTDOWN_GRACE));
+    await Promise.allSettled([...jobs]);
+    await runner.cleanup();
+  } catch (error) {
+    logger.error('Failed to clean up containers:', error);
   }
 };
 
@@ -41,7 +49,7 @@ const processJob = async (job: any) => {
   const containerId = `runner-${RUNNER_ID}-${job.submissionId}`;
   
   try {
-    const result = await processSubmission(docker, job, config);
+    const result = await processSubmission(runner, job, config);
     
     const signedResult = {
       ...result,
@@ -79,6 +87,10 @@ const processJob = async (job: any) => {
 };
 
 const pollQueue = async () => {
+  if (shuttingDown || runner.inFlight() + runner.queued() >= CONCURRENCY) {
+    return;
+  }
+
   try {
     const response = await fetch(`${config.apiUrl}/api/runner/job`, {
       headers: {
@@ -95,13 +107,11 @@ const pollQueue = async () => {
     }
 
     const job = await response.json();
-    
-    if (activeContainers.size >= CONCURRENCY) {
-      logger.warn('Max concurrency reached, skipping job');
-      return;
-    }
 
-    processJob(job);
+    const processing = processJob(job)
+      .catch((error) => logger.error(`Failed to report submission ${job.submissionId}:`, error))
+      .finally(() => jobs.delete(processing));
+    jobs.add(processing);
   } catch (error) {
     logger.error('Failed to poll queue:', error);
   }
@@ -110,11 +120,28 @@ const pollQueue = async () => {
 const main = async () => {
   logger.info(`Starting runner ${RUNNER_ID}...`);
 
+  await runner.cleanup();
+  await warmup(docker);
+
+  if (config.pruneImagesOnStart) {
+    try {
+      await runner.pruneImages(1);
+    } catch (error) {
+      logger.error('Failed to prune stale images:', error);
+    }
+  }
+
   await registerRunner(RUNNER_ID, config);
 
   setInterval(() => heartbeat(RUNNER_ID, config), 30000);
   setInterval(pollQueue, 1000);
 
+  if (config.serverPort) {
+    createServer(runner, config, { metrics }).listen(config.serverPort, () => {
+      logger.info(`Execute API listening on port ${config.serverPort}`);
+    });
+  }
+
   logger.info(`Runner ${RUNNER_ID} started with concurrency ${CONCURRENCY}`);
 };
 
@@ -0,0 +1,360 @@
+import { readFileSync } from 'fs';
+
+export interface DependencySupport {
+  // Directory the install command creates under /workspace; the cached copy
+  // is mounted back at the same path for the run.
+  directory: string;
+  installCommand: (packages: string[]) => string[];
+  // Every spec must match in full, on top of the generic checks, for install
+  // commands that put specs into a file the package manager evaluates.
+  specPattern?: RegExp;
+}
+
+export interface BuildCache {
+  // Where the volume is mounted. The image must create it owned by the
+  // runner user, since a new volume takes its owner from the mount point.
+  path: string;
+  // Points the toolchain's caches into path.
+  env: Record<string, string>;
+  // Run on the submission's workspace in the install sandbox, with network,
+  // before compiling, to download what the sources import into the cache.
+  fetchCommand?: string[];
+  // Mount the cache read-only in the compile step as well, for toolchains
+  // that compile the fetched sources straight from it.
+  readInCompile?: boolean;
+}
+
+export interface Language {
+  // Compiler or interpreter version this entry provides; a language may be
+  // registered once per version.
+  version: string;
+  // Image repository; when a dockerfile is given the tag is derived from it,
+  // otherwise the image is used as-is and must already be present.
+  image: string;
+  dockerfile?: string;
+  fileName: string;
+  // Source file extensions, used by detectLanguage.
+  extensions?: string[];
+  compileCommand?: string[];
+  runCommand: string[];
+  // Interactive interpreter for sessions, reading from a non-tty stdin.
+  replCommand?: string[];
+  // Derives fileName and runCommand from the submitted source, for languages
+  // where they depend on what the source declares.
+  entryPoint?: (code: string) => EntryPoint;
+  dependencies?: DependencySupport;
+  buildCache?: BuildCache;
+  // Set on top of the runner-wide pins when a request asks for a
+  // deterministic run.
+  deterministicEnv?: Record<string, string>;
+}
+
+export interface EntryPoint {
+  fileName: string;
+  runCommand: string[];
+}
+
+const languages = new Map<string, Map<string, Language>>();
+
+// Points crates.io at the crates vendored by the Rust install step.
+const CARGO_VENDOR_CONFIG =
+  '[source.crates-io]\\nreplace-with = "vendored"\\n' +
+  '[source.vendored]\\ndirectory = "vendor/crates"\\n';
+
+// Dockerfiles live under runner/languages/<name>/ (or <name>/<version>/ for
+// languages with several versions) and are read once at load, relative to
+// this module, so they ship with the package rather than being looked up from
+// the working directory.
+const readDockerfile = (dir: string): string => {
+  const dockerfile = readFileSync(
+    new URL(`../languages/${dir}/Dockerfile`, import.meta.url),
+    'utf-8'
+  );
+
+  if (!/^\s*FROM\s+\S+/im.test(dockerfile)) {
+    throw new Error(`Dockerfile for ${dir} has no FROM instruction`);
+  }
+
+  return dockerfile;
+};
+
+// Compares dotted version strings numerically, so 1.10 sorts after 1.9.
+const compareVersions = (a: string, b: string): number => {
+  const left = a.split('.').map((part) => parseInt(part, 10) || 0);
+  const right = b.split('.').map((part) => parseInt(part, 10) || 0);
+
+  for (let i = 0; i < Math.max(left.length, right.length); i++) {
+    const diff = (left[i] ?? 0) - (right[i] ?? 0);
+    if (diff !== 0) {
+      return diff;
+    }
+  }
+  return 0;
+};
+
+export const resolveEntryPoint = (language: Language, code?: string): EntryPoint => {
+  if (language.entryPoint && code !== undefined) {
+    return language.entryPoint(code);
+  }
+  return { fileName: language.fileName, runCommand: language.runCommand };
+};
+
+// javac requires a public top-level type to live in a file of the same name,
+// and a type in a package to sit in the matching directory. Comments and
+// literals are blanked first so a class named inside them is not picked up.
+const javaEntryPoint = (code: string): EntryPoint => {
+  const source = code
+    .replace(/\/\*[\s\S]*?\*\//g, ' ')
+    .replace(/\/\/[^\n]*/g, ' ')
+    .replace(/"""[\s\S]*?"""|"(?:\\.|[^"\\\n])*"|'(?:\\.|[^'\\\n])*'/g, '""');
+
+  const pkg = /^\s*package\s+([\w$]+(?:\s*\.\s*[\w$]+)*)\s*;/m
+    .exec(source)?.[1]
+    .replace(/\s+/g, '');
+  const type =
+    /\bpublic\s+(?:(?:final|abstract|strictfp|sealed|non-sealed)\s+)*(?:class|interface|enum|record)\s+([A-Za-z_$][\w$]*)/;
+  const className = type.exec(source)?.[1] ?? 'Main';
+  const qualified = pkg ? `${pkg}.${className}` : className;
+
+  return {
+    fileName: `${qualified.replace(/\./g, '/')}.java`,
+    runCommand: ['java', '-cp', '/workspace', qualified],
+  };
+};
+
+export const registerLanguage = (name: string, language: Language): void => {
+  const versions = languages.get(name) ?? new Map<string, Language>();
+  versions.set(language.version, language);
+  languages.set(name, versions);
+};
+
+// Without a version the latest registered one is returned.
+export const getLanguage = (name: string, version?: string): Language | undefined => {
+  const versions = languages.get(name);
+  if (!versions) {
+    return undefined;
+  }
+
+  if (version !== undefined) {
+    return versions.get(version);
+  }
+
+  const latest = listVersions(name).pop();
+  return latest === undefined ? undefined : versions.get(latest);
+};
+
+export const listLanguages = (): string[] => {
+  return [...languages.keys()].sort();
+};
+
+// Returns the registered language for a file name's extension, or undefined
+// when no language or more than one claims it.
+export const detectLanguage = (fileName: string): string | undefined => {
+  const dot = fileName.lastIndexOf('.');
+  if (dot <= fileName.lastIndexOf('/')) {
+    return undefined;
+  }
+
+  const extension = fileName.slice(dot).toLowerCase();
+  const matches = listLanguages().filter((name) =>
+    [...languages.get(name)!.values()].some((language) => language.extensions?.includes(extension))
+  );
+
+  return matches.length === 1 ? matches[0] : undefined;
+};
+
+// Oldest first.
+export const listVersions = (name: string): string[] => {
+  return [...(languages.get(name)?.keys() ?? [])].sort(compareVersions);
+};
+
+// C and C++ share the gcc image. Every source file of the language in the
+// workspace is compiled, so multi-file submissions link without a build file.
+registerLanguage('c', {
+  version: '13',
+  image: 'codecontest/cpp-runner',
+  dockerfile: readDockerfile('cpp'),
+  fileName: 'main.c',
+  extensions: ['.c'],
+  compileCommand: ['/bin/sh', '-c', 'gcc -std=c11 -O2 -o main *.c -lm'],
+  runCommand: ['./main'],
+});
+
+registerLanguage('cpp', {
+  version: '13',
+  image: 'codecontest/cpp-runner',
+  dockerfile: readDockerfile('cpp'),
+  fileName: 'main.cpp',
+  extensions: ['.cpp', '.cc', '.cxx'],
+  compileCommand: ['/bin/sh', '-c', 'g++ -std=c++17 -O2 -o main *.cpp'],
+  runCommand: ['./main'],
+});
+
+registerLanguage('java', {
+  version: '17',
+  image: 'codecontest/java-runner',
+  dockerfile: readDockerfile('java'),
+  fileName: 'Main.java',
+  extensions: ['.java'],
+  compileCommand: ['/bin/sh', '-c', 'javac $(find . -name "*.java")'],
+  runCommand: ['java', '-cp', '/workspace', 'Main'],
+  entryPoint: javaEntryPoint,
+});
+
+for (const version of ['3.11', '3.12']) {
+  registerLanguage('python', {
+    version,
+    image: 'codecontest/python-runner',
+    dockerfile: readDockerfile(`python/${version}`),
+    fileName: 'main.py',
+    extensions: ['.py'],
+    runCommand: ['python3', 'main.py'],
+    replCommand: ['python3', '-i', '-q', '-u'],
+    // Fixes str, bytes and datetime hashes, and with them set iteration order.
+    deterministicEnv: { PYTHONHASHSEED: '0' },
+  });
+}
+
+registerLanguage('javascript', {
+  version: '20',
+  image: 'codecontest/nodejs-runner',
+  dockerfile: readDockerfile('javascript'),
+  fileName: 'main.js',
+  extensions: ['.js'],
+  runCommand: ['node', 'main.js'],
+  replCommand: ['node', '-i'],
+  dependencies: {
+    directory: 'node_modules',
+    installCommand: (packages) => [
+      'npm',
+      'install',
+      '--ignore-scripts',
+      '--no-audit',
+      '--no-fund',
+      '--no-save',
+      '--prefix',
+      '/workspace',
+      ...packages,
+    ],
+  },
+});
+
+registerLanguage('ruby', {
+  version: '3.3',
+  image: 'codecontest/ruby-runner',
+  dockerfile: readDockerfile('ruby'),
+  fileName: 'main.rb',
+  extensions: ['.rb'],
+  // Gems installed by the dependency step come with a standalone bundler
+  // setup that puts them on the load path without needing rubygems to find
+  // them.
+  runCommand: [
+    '/bin/sh',
+    '-c',
+    '[ -f gems/bundler/setup.rb ] && exec ruby -r./gems/bundler/setup main.rb "$@"; ' +
+      'exec ruby main.rb "$@"',
+    'sh',
+  ],
+  dependencies: {
+    directory: 'gems',
+    // name or name@requirement, e.g. rack@~>3.0. The Gemfile is Ruby, so
+    // nothing else may reach it. Gems with native extensions still run their
+    // extconf.rb during the install, since bundler cannot skip it.
+    specPattern: /^[A-Za-z0-9][A-Za-z0-9._-]*(@(~>|>=|<=|!=|=|>|<)?[0-9]+(\.[0-9A-Za-z]+)*)?$/,
+    installCommand: (packages) => [
+      '/bin/sh',
+      '-c',
+      [
+        `echo 'source "https://rubygems.org"' > Gemfile`,
+        'for spec; do case "$spec" in ' +
+          `*@*) printf 'gem "%s", "%s"\\n' "\${spec%%@*}" "\${spec#*@}" ;; ` +
+          `*) printf 'gem "%s"\\n' "$spec" ;; ` +
+          'esac; done >> Gemfile',
+        'BUNDLE_PATH=gems bundle install --standalone --quiet',
+      ].join(' && '),
+      'sh',
+      ...packages,
+    ],
+  },
+});
+
+for (const version of ['1.21', '1.22']) {
+  registerLanguage('go', {
+    version,
+    image: 'codecontest/go-runner',
+    dockerfile: readDockerfile(`go/${version}`),
+    fileName: 'main.go',
+    extensions: ['.go'],
+    // The generated go.mod declares the toolchain's own version, so language
+    // features are gated by the selected version.
+    compileCommand: [
+      '/bin/sh',
+      '-c',
+      '[ -f go.mod ] || go mod init submission >/dev/null 2>&1; go build -o main .',
+    ],
+    runCommand: ['./main'],
+    // Downloaded modules, shared by both Go versions. go mod tidy resolves
+    // the imports into go.mod and go.sum, so go build only reads the cache.
+    buildCache: {
+      path: '/cache/go',
+      env: { GOMODCACHE: '/cache/go/mod' },
+      fetchCommand: [
+        '/bin/sh',
+        '-c',
+        '[ -f go.mod ] || go mod init submission >/dev/null 2>&1; go mod tidy',
+      ],
+      readInCompile: true,
+    },
+    // Seeds math/rand's top-level functions with 1, as before Go 1.20. Map
+    // iteration order stays randomized; no setting turns that off.
+    deterministicEnv: { GODEBUG: 'randautoseed=0' },
+  });
+}
+
+registerLanguage('rust', {
+  version: '1.78',
+  image: 'codecontest/rust-runner',
+  dockerfile: readDockerfile('rust'),
+  fileName: 'main.rs',
+  extensions: ['.rs'],
+  // Plain submissions are a single rustc call. With dependencies the install
+  // step leaves a resolved manifest and the vendored crates under vendor/, and
+  // the source is built as a Cargo project against them, offline. Every .rs
+  // file moves into src/ with its path kept, so mod declarations resolve as
+  // they do for rustc.
+  compileCommand: [
+    '/bin/sh',
+    '-c',
+    [
+      'if [ ! -d vendor ]; then exec rustc -O -o main main.rs; fi',
+      'mkdir -p src .cargo',
+      'cp vendor/Cargo.toml vendor/Cargo.lock .',
+      'find . -name "*.rs" ! -path "./vendor/*" ! -path "./src/*" | tar cf - -T - | tar xf - -C src',
+      `printf '${CARGO_VENDOR_CONFIG}' > .cargo/config.toml`,
+      'cargo build --release --offline --quiet',
+      'cp target/release/submission main',
+    ].join(' && '),
+  ],
+  runCommand: ['./main'],
+  // The registry index and downloaded crates, for the install step only: the
+  // build is offline against vendor/.
+  buildCache: {
+    path: '/cache/cargo',
+    env: { CARGO_HOME: '/cache/cargo' },
+  },
+  dependencies: {
+    directory: 'vendor',
+    installCommand: (packages) => [
+      '/bin/sh',
+      '-c',
+      [
+        'cargo init --name submission --vcs none --quiet .',
+        'cargo add --quiet "$@"',
+        'cargo vendor --quiet --versioned-dirs vendor/crates > /dev/null',
+        'cp Cargo.toml Cargo.lock vendor/',
+      ].join(' && '),
+      'sh',
+      ...packages,
+    ],
+  },
+});
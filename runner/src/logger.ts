@@ -21,3 +21,20 @@ export const logger = winston.createLogger({
     }),
   ],
 });
+
+export type LogFields = Record<string, unknown>;
+
+// Receives the runner's per-run events (image builds, containers created and
+// killed, runs finished) with structured fields. The winston logger above
+// fits this shape; library users get noopLogger unless they pass one.
+export interface RunnerLogger {
+  debug: (message: string, fields?: LogFields) => void;
+  info: (message: string, fields?: LogFields) => void;
+  warn: (message: string, fields?: LogFields) => void;
+}
+
+export const noopLogger: RunnerLogger = {
+  debug: () => {},
+  info: () => {},
+  warn: () => {},
+};
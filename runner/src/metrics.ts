@@ -0,0 +1,88 @@
+import { Counter, Histogram, Registry } from 'prom-client';
+import { ExecutionResult, TestRunResult } from './executor.js';
+
+export type ExecutionOutcome =
+  | 'success'
+  | 'compile_error'
+  | 'runtime_error'
+  | 'timeout'
+  | 'oom'
+  | 'system_error';
+
+const DURATION_BUCKETS = [0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60];
+const MEMORY_BUCKETS = [1, 4, 16, 64, 128, 256, 512, 1024, 2048].map((mib) => mib * 1024 * 1024);
+
+export const executionOutcome = (result: ExecutionResult): ExecutionOutcome => {
+  if (result.compileError !== undefined) {
+    return 'compile_error';
+  }
+  if (result.oomKilled) {
+    return 'oom';
+  }
+  if (result.timedOut) {
+    return 'timeout';
+  }
+  if (result.exitCode !== 0 || result.outputTruncated) {
+    return 'runtime_error';
+  }
+  return 'success';
+};
+
+// A test run's outcome is its build's, when that failed, or else that of the
+// first case that didn't succeed.
+export const testRunOutcome = (result: TestRunResult): ExecutionOutcome => {
+  if (result.compileError !== undefined) {
+    return 'compile_error';
+  }
+  return result.cases.map(executionOutcome).find((outcome) => outcome !== 'success') ?? 'success';
+};
+
+// Registers the runner's execution metrics on the caller's registry, and only
+// there. Exactly one of record() and recordTestRun() is called per call into
+// the runner, with undefined when it threw. Each test case counts towards the
+// histograms as a run of its own.
+export const createExecutionMetrics = (registry: Registry) => {
+  const runs = new Counter({
+    name: 'codecontest_runner_executions_total',
+    help: 'Executions by language and outcome.',
+    labelNames: ['language', 'outcome'],
+    registers: [registry],
+  });
+  const duration = new Histogram({
+    name: 'codecontest_runner_execution_duration_seconds',
+    help: 'Wall-clock duration of the program run.',
+    labelNames: ['language'],
+    buckets: DURATION_BUCKETS,
+    registers: [registry],
+  });
+  const memory = new Histogram({
+    name: 'codecontest_runner_execution_peak_memory_bytes',
+    help: 'Peak memory usage of the program run, where it could be measured.',
+    labelNames: ['language'],
+    buckets: MEMORY_BUCKETS,
+    registers: [registry],
+  });
+
+  const observe = (language: string, result: ExecutionResult) => {
+    duration.observe({ language }, result.duration / 1000);
+    if (result.peakMemoryBytes !== undefined) {
+      memory.observe({ language }, result.peakMemoryBytes);
+    }
+  };
+
+  return {
+    record: (language: string, result?: ExecutionResult) => {
+      if (!result) {
+        runs.inc({ language, outcome: 'system_error' });
+        return;
+      }
+
+      runs.inc({ language, outcome: executionOutcome(result) });
+      observe(language, result);
+    },
+    recordTestRun: (language: string, result: TestRunResult) => {
+      runs.inc({ language, outcome: testRunOutcome(result) });
+      result.cases.forEach((testCase) => observe(language, testCase));
+    },
+  };
+};
@@ -0,0 +1,401 @@
+import Docker from 'dockerode';
+import { chmod, mkdir, mkdtemp, readdir, rm } from 'fs/promises';
+import { join } from 'path';
+import { RunnerConfig } from './config.js';
+import { DockerClient } from './docker.js';
+import { logger, RunnerLogger } from './logger.js';
+import { getLanguage, resolveEntryPoint } from './languages.js';
+import { ensureImage, runnerLabels } from './images.js';
+import { WorkspaceSetupError } from './errors.js';
+import {
+  buildEnv,
+  checkRuntime,
+  collectFiles,
+  collectOutputFiles,
+  createCollector,
+  createOutputLimit,
+  defaultSandbox,
+  exitSignal,
+  sandboxHostConfig,
+  writeWorkspace,
+  DEFAULT_MAX_OUTPUT_BYTES,
+  DEFAULT_MAX_OUTPUT_FILES_BYTES,
+  ExecutionRequest,
+  ExecutionResult,
+} from './executor.js';
+
+export interface PoolOptions {
+  size: number;
+  languages: string[];
+}
+
+export interface ContainerPool {
+  supports: (request: ExecutionRequest) => boolean;
+  execute: (request: ExecutionRequest) => Promise<ExecutionResult>;
+  close: () => Promise<void>;
+}
+
+interface PooledContainer {
+  container: Docker.Container;
+  workspace: string;
+}
+
+interface ExecRun {
+  command: string[];
+  env: string[];
+  stdin?: string | Buffer;
+  timeout: number;
+  maxOutputBytes: number;
+  signal?: AbortSignal;
+  log: RunnerLogger;
+}
+
+const IDLE_COMMAND = ['tail', '-f', '/dev/null'];
+const RESET_TIMEOUT = 5000;
+
+// kill -1 signals every process the caller may signal except PID 1 and the
+// calling shell itself, so nothing started by the previous run survives.
+// What it may have left in /dev/shm, which Docker mounts writable even with a
+// read-only root, and System V shared memory, semaphores and message queues,
+// which outlive their processes in the container's IPC namespace, goes too.
+const RESET_COMMAND = [
+  '/bin/sh',
+  '-c',
+  'kill -9 -1 2>/dev/null; ' +
+    [
+      'find /tmp /dev/shm -mindepth 1 -delete',
+      "for id in $(awk 'NR > 1 { print $2 }' /proc/sysvipc/shm); do ipcrm -m $id || exit 1; done",
+      "for id in $(awk 'NR > 1 { print $2 }' /proc/sysvipc/sem); do ipcrm -s $id || exit 1; done",
+      "for id in $(awk 'NR > 1 { print $2 }' /proc/sysvipc/msg); do ipcrm -q $id || exit 1; done",
+    ].join(' && '),
+];
+
+const clearDirectory = async (dir: string): Promise<void> => {
+  for (const entry of await readdir(dir)) {
+    await rm(join(dir, entry), { recursive: true, force: true });
+  }
+};
+
+// Runs one command with docker exec in an already running container. A
+// timeout or output overflow kills the whole container, since an exec'd
+// process cannot be killed through the API; such a container is unhealthy
+// and must not be reused.
+const runExec = async (
+  docker: DockerClient,
+  container: Docker.Container,
+  run: ExecRun
+): Promise<{ result: ExecutionResult; healthy: boolean }> => {
+  let killed = false;
+  const kill = async (reason: string) => {
+    if (!killed) {
+      run.log.info('Killing container', { containerId: container.id, reason });
+    }
+    killed = true;
+    try {
+      await container.kill({ signal: 'SIGKILL' });
+    } catch (e) {}
+  };
+
+  const exec = await container.exec({
+    Cmd: run.command,
+    Env: run.env,
+    WorkingDir: '/workspace',
+    AttachStdin: true,
+    AttachStdout: true,
+    AttachStderr: true,
+  });
+
+  const outputLimit = createOutputLimit(run.maxOutputBytes, () => kill('output limit'));
+  const stdout = createCollector(outputLimit);
+  const stderr = createCollector(outputLimit);
+
+  const stream = await exec.start({ hijack: true, stdin: true });
+  docker.modem.demuxStream(stream, stdout.stream, stderr.stream);
+
+  const streamClosed = new Promise<void>((resolve) => {
+    stream.on('end', resolve);
+    stream.on('close', resolve);
+    stream.on('error', () => resolve());
+  });
+
+  let timedOut = false;
+  const expire = (reason: string) => {
+    timedOut = true;
+    kill(reason);
+  };
+  const onAbort = () => expire('aborted');
+
+  const startTime = Date.now();
+  const timer = setTimeout(() => expire('timeout'), run.timeout);
+  run.signal?.addEventListener('abort', onAbort, { once: true });
+
+  try {
+    stream.end(run.stdin ?? '');
+    await streamClosed;
+  } finally {
+    clearTimeout(timer);
+    run.signal?.removeEventListener('abort', onAbort);
+  }
+
+  const duration = Date.now() - startTime;
+
+  // A killed container removes itself (AutoRemove), taking the exec with it,
+  // so there is nothing left to inspect.
+  let exitCode = 137;
+  let oomKilled = false;
+  let healthy = false;
+
+  if (!killed) {
+    try {
+      const info = await exec.inspect();
+      const state = (await container.inspect()).State;
+      exitCode = info.ExitCode ?? 137;
+      oomKilled = state.OOMKilled;
+      healthy = state.Running && !state.OOMKilled;
+    } catch (e) {}
+  }
+
+  return {
+    result: {
+      stdout: stdout.text(),
+      stderr: stderr.text(),
+      exitCode,
+      signal: exitSignal(exitCode),
+      timedOut,
+      oomKilled,
+      outputTruncated: outputLimit.truncated(),
+      duration,
+    },
+    healthy,
+  };
+};
+
+// Keeps `size` idle containers per language running a sleeping entrypoint and
+// execs each run into one of them, skipping container start-up. Only
+// interpreted languages qualify, and only requests that keep the default
+// container limits, since those are fixed when the container is created.
+// Between runs every leftover process is killed and /workspace and /tmp are
+// emptied; a container that was killed or looks unhealthy is discarded.
+// Peak memory is not reported for pooled runs because the cgroup is shared
+// across them.
+export const createContainerPool = (
+  docker: DockerClient,
+  config: RunnerConfig,
+  options: PoolOptions,
+  log: RunnerLogger
+): ContainerPool => {
+  const idle = new Map<string, PooledContainer[]>();
+  const starting = new Map<string, number>();
+  let closed = false;
+
+  const start = async (name: string): Promise<PooledContainer> => {
+    const image = await ensureImage(docker, name, undefined, log, config.autoBuildImages);
+    if (config.runtime) {
+      await checkRuntime(docker, config.runtime);
+    }
+
+    await mkdir(config.workspaceDir, { recursive: true });
+    const workspace = await mkdtemp(join(config.workspaceDir, `${config.runnerId}-pool-`));
+    let container: Docker.Container | undefined;
+
+    try {
+      await chmod(workspace, 0o777);
+      container = await docker.createContainer({
+        Image: image,
+        Cmd: IDLE_COMMAND,
+        HostConfig: {
+          ...sandboxHostConfig({ ...(await defaultSandbox(config)), workspace, binds: [] }),
+          AutoRemove: true,
+        },
+        Labels: runnerLabels(config),
+        WorkingDir: '/workspace',
+      });
+      await container.start();
+      log.debug('Pooled container started', { containerId: container.id, language: name });
+      return { container, workspace };
+    } catch (error) {
+      if (container) {
+        try {
+          await container.remove({ force: true });
+        } catch (e) {}
+      }
+      await rm(workspace, { recursive: true, force: true });
+      throw error;
+    }
+  };
+
+  const destroy = async (pooled: PooledContainer): Promise<void> => {
+    try {
+      await pooled.container.remove({ force: true });
+    } catch (e) {}
+    await rm(pooled.workspace, { recursive: true, force: true });
+  };
+
+  const replenish = (name: string): void => {
+    const pending = starting.get(name) ?? 0;
+    const available = idle.get(name)?.length ?? 0;
+
+    if (closed || pending + available >= options.size) {
+      return;
+    }
+
+    starting.set(name, pending + 1);
+    start(name)
+      .then((pooled) => {
+        if (closed) {
+          return destroy(pooled);
+        }
+        idle.get(name)?.push(pooled);
+      })
+      .catch((error) => {
+        logger.error(`Failed to start pooled container for ${name}:`, error);
+      })
+      .finally(() => {
+        starting.set(name, (starting.get(name) ?? 1) - 1);
+      });
+  };
+
+  // Kills every process the last run left behind and clears what it left in
+  // memory. False when any of that failed and the container has to go.
+  const reset = async (pooled: PooledContainer): Promise<boolean> => {
+    const { result, healthy } = await runExec(docker, pooled.container, {
+      command: RESET_COMMAND,
+      env: [],
+      timeout: RESET_TIMEOUT,
+      maxOutputBytes: DEFAULT_MAX_OUTPUT_BYTES,
+      log,
+    });
+    return healthy && result.exitCode === 0;
+  };
+
+  const recycle = async (name: string, pooled: PooledContainer, healthy: boolean) => {
+    try {
+      if (healthy && !closed) {
+        const clean = await reset(pooled);
+        await clearDirectory(pooled.workspace);
+
+        const containers = idle.get(name);
+        if (clean && containers && containers.length < options.size && !closed) {
+          containers.push(pooled);
+          return;
+        }
+      }
+      await destroy(pooled);
+    } catch (error) {
+      logger.error(`Failed to recycle pooled container for ${name}:`, error);
+      await destroy(pooled);
+    }
+    replenish(name);
+  };
+
+  for (const name of options.languages) {
+    idle.set(name, []);
+    for (let i = 0; i < options.size; i++) {
+      replenish(name);
+    }
+  }
+
+  // The pooled language the request names. One that leaves the language to
+  // be detected from its file name is not pooled.
+  const pooledLanguage = (request: ExecutionRequest): string | undefined => {
+    return request.language !== undefined && options.languages.includes(request.language)
+      ? request.language
+      : undefined;
+  };
+
+  return {
+    supports: (request) => {
+      const name = pooledLanguage(request);
+      const language = name === undefined ? undefined : getLanguage(name);
+
+      return (
+        language !== undefined &&
+        request.version === undefined &&
+        !language.compileCommand &&
+        !request.dependencies?.length &&
+        request.memoryLimitBytes === undefined &&
+        request.pidsLimit === undefined &&
+        request.cpuLimit === undefined &&
+        request.cpuShares === undefined &&
+        request.ulimits === undefined &&
+        request.diskLimitBytes === undefined &&
+        request.seccompProfile === undefined &&
+        request.runtime === undefined &&
+        request.user === undefined &&
+        (request.network ?? 'none') === 'none' &&
+        (request.readOnlyRootFs ?? true)
+      );
+    },
+
+    execute: async (request) => {
+      const name = pooledLanguage(request);
+      const language = name === undefined ? undefined : getLanguage(name);
+
+      if (name === undefined || !language) {
+        throw new Error(`Language ${request.language} is not pooled`);
+      }
+
+      const entryPoint = resolveEntryPoint(language, request.code);
+      const files = collectFiles(request, entryPoint.fileName);
+      const env = buildEnv(request);
+
+      request.signal?.throwIfAborted();
+
+      const pooled = idle.get(name)?.pop() ?? (await start(name));
+      replenish(name);
+
+      let healthy = false;
+      try {
+        try {
+          await writeWorkspace(pooled.workspace, files);
+        } catch (error) {
+          throw new WorkspaceSetupError(error);
+        }
+
+        const run = await runExec(docker, pooled.container, {
+          command: [...entryPoint.runCommand, ...(request.args ?? [])],
+          env,
+          stdin: request.stdin,
+          timeout: request.timeout ?? config.maxExecutionTime,
+          maxOutputBytes: request.maxOutputBytes ?? DEFAULT_MAX_OUTPUT_BYTES,
+          signal: request.signal,
+          log,
+        });
+
+        healthy = run.healthy;
+        if (!request.outputFiles?.length) {
+          return run.result;
+        }
+
+        // Processes the program left in the background could still swap the
+        // files while they are read, so they are all killed first, or the
+        // whole container if that does not work.
+        healthy = healthy && (await reset(pooled).catch(() => false));
+        if (!healthy) {
+          try {
+            await pooled.container.kill({ signal: 'SIGKILL' });
+            await pooled.container.wait({ condition: 'not-running' });
+          } catch (e) {}
+        }
+
+        return {
+          ...run.result,
+          ...(await collectOutputFiles(
+            pooled.workspace,
+            request.outputFiles,
+            request.maxOutputFilesBytes ?? DEFAULT_MAX_OUTPUT_FILES_BYTES
+          )),
+        };
+      } finally {
+        void recycle(name, pooled, healthy);
+      }
+    },
+
+    close: async () => {
+      closed = true;
+      const containers = [...idle.values()].flat();
+      idle.clear();
+      await Promise.all(containers.map(destroy));
+    },
+  };
+};
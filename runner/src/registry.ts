@@ -1,5 +1,6 @@
 import { RunnerConfig } from './config.js';
 import { logger } from './logger.js';
+import { listLanguages } from './languages.js';
 
 export const registerRunner = async (runnerId: string, config: RunnerConfig): Promise<void> => {
   try {
@@ -11,7 +12,7 @@ export const registerRunner = async (runnerId: string, config: RunnerConfig): Pr
       body: JSON.stringify({
         runnerId,
         publicKey: config.publicKey,
-        capabilities: ['cpp', 'java', 'python', 'javascript', 'go', 'rust'],
+        capabilities: listLanguages(),
         maxConcurrency: config.concurrency,
       }),
     });
@@ -0,0 +1,458 @@
+import { readdir, rm } from 'fs/promises';
+import { join } from 'path';
+import { Registry } from 'prom-client';
+import { RunnerConfig } from './config.js';
+import { DockerClient } from './docker.js';
+import { logger, noopLogger, RunnerLogger } from './logger.js';
+import { OWNER_LABEL, OWNER_LABEL_VALUE, RUNNER_ID_LABEL, pruneImages } from './images.js';
+import {
+  execute,
+  executeStream,
+  runTestCases,
+  validate,
+  ExecutionRequest,
+  ExecutionResult,
+  OutputStreams,
+  TestCase,
+  TestCaseOptions,
+  TestRunResult,
+} from './executor.js';
+import { createContainerPool, PoolOptions } from './pool.js';
+import { createExecutionMetrics, executionOutcome, testRunOutcome } from './metrics.js';
+import { ShuttingDownError, toRunnerError } from './errors.js';
+import { startSession, Session, SessionOptions } from './session.js';
+import { detectLanguage, getLanguage } from './languages.js';
+import { createResultCache, CacheStats, ResultCacheOptions } from './cache.js';
+
+export interface RunnerOptions {
+  maxConcurrency?: number;
+  pool?: PoolOptions;
+  // Receives the execution metrics; nothing is recorded without one.
+  metrics?: Registry;
+  // Per-run events; nothing is logged through it by default.
+  logger?: RunnerLogger;
+  // Enables the result cache for execute and executeBatch.
+  cache?: ResultCacheOptions;
+}
+
+export interface Runner {
+  execute: (request: ExecutionRequest) => Promise<ExecutionResult>;
+  executeStream: (request: ExecutionRequest, streams: OutputStreams) => Promise<ExecutionResult>;
+  // Runs every request through the same slots as execute, so at most
+  // maxConcurrency at once, and settles each independently: results[i]
+  // belongs to requests[i]. Aborting signal aborts the ones not yet done.
+  executeBatch: (
+    requests: ExecutionRequest[],
+    signal?: AbortSignal
+  ) => Promise<PromiseSettledResult<ExecutionResult>[]>;
+  runTestCases: (
+    request: ExecutionRequest,
+    cases: TestCase[],
+    options?: TestCaseOptions
+  ) => Promise<TestRunResult>;
+  // Resolves when the request would be accepted by execute; throws the same
+  // errors otherwise. Starts no container and takes no slot.
+  validate: (request: ExecutionRequest) => Promise<void>;
+  // Holds a concurrency slot for as long as the session is open.
+  startSession: (language: string, options?: SessionOptions) => Promise<Session>;
+  inFlight: () => number;
+  queued: () => number;
+  ping: () => Promise<void>;
+  // Stops accepting calls (they fail with ShuttingDownError) and waits for
+  // the accepted ones to finish. Once signal aborts, the remaining runs are
+  // killed and their containers removed; it resolves when all have settled.
+  shutdown: (signal?: AbortSignal) => Promise<void>;
+  close: () => Promise<void>;
+  pruneImages: (keepLatest: number) => Promise<string[]>;
+  cleanup: () => Promise<void>;
+  // Lookups of cacheable requests since the runner was created; all zero
+  // without a cache.
+  cacheStats: () => CacheStats;
+}
+
+const createSemaphore = (size: number) => {
+  let active = 0;
+  const waiters: Array<() => void> = [];
+
+  const acquire = (signal?: AbortSignal): Promise<void> => {
+    signal?.throwIfAborted();
+
+    if (active < size) {
+      active++;
+      return Promise.resolve();
+    }
+
+    return new Promise<void>((resolve, reject) => {
+      const onAbort = () => {
+        const index = waiters.indexOf(grant);
+        if (index !== -1) {
+          waiters.splice(index, 1);
+        }
+        reject(signal?.reason);
+      };
+      const grant = () => {
+        signal?.removeEventListener('abort', onAbort);
+        active++;
+        resolve();
+      };
+
+      waiters.push(grant);
+      signal?.addEventListener('abort', onAbort, { once: true });
+    });
+  };
+
+  const release = () => {
+    active--;
+    waiters.shift()?.();
+  };
+
+  return {
+    acquire,
+    release,
+    active: () => active,
+    waiting: () => waiters.length,
+  };
+};
+
+// An AbortSignal that aborts as soon as any of the given ones does. dispose()
+// takes its listeners off the given signals again, for when whatever used it
+// has settled; a long-lived signal would otherwise collect one per call.
+const anySignal = (
+  signals: Array<AbortSignal | undefined>
+): { signal?: AbortSignal; dispose: () => void } => {
+  const present = signals.filter((signal): signal is AbortSignal => signal !== undefined);
+  if (present.length <= 1) {
+    return { signal: present[0], dispose: () => {} };
+  }
+
+  const controller = new AbortController();
+  const listeners: Array<[AbortSignal, () => void]> = [];
+  for (const signal of present) {
+    if (signal.aborted) {
+      controller.abort(signal.reason);
+      break;
+    }
+    const onAbort = () => controller.abort(signal.reason);
+    signal.addEventListener('abort', onAbort, { once: true });
+    listeners.push([signal, onAbort]);
+  }
+
+  return {
+    signal: controller.signal,
+    dispose: () => {
+      for (const [signal, onAbort] of listeners) {
+        signal.removeEventListener('abort', onAbort);
+      }
+    },
+  };
+};
+
+const removeLeftoverDirectories = async (dir: string, prefix: string): Promise<void> => {
+  let entries: string[];
+  try {
+    entries = await readdir(dir);
+  } catch (e) {
+    return;
+  }
+
+  for (const entry of entries.filter((name) => name.startsWith(prefix))) {
+    await rm(join(dir, entry), { recursive: true, force: true });
+  }
+};
+
+// Force-removes every container and volume carrying this runner's labels and
+// every workspace directory it created. Intended for start-up, to reclaim what a
+// crashed process left behind; calling it while runs are in flight kills
+// them.
+const cleanup = async (docker: DockerClient, config: RunnerConfig): Promise<void> => {
+  const containers = await docker.listContainers({
+    all: true,
+    filters: {
+      label: [`${OWNER_LABEL}=${OWNER_LABEL_VALUE}`, `${RUNNER_ID_LABEL}=${config.runnerId}`],
+    },
+  });
+
+  for (const info of containers) {
+    try {
+      await docker.getContainer(info.Id).remove({ force: true });
+      logger.info(`Removed leftover container ${info.Id}`);
+    } catch (error) {
+      logger.error(`Failed to remove leftover container ${info.Id}:`, error);
+    }
+  }
+
+  const { Volumes: volumes } = await docker.listVolumes({
+    filters: {
+      label: [`${OWNER_LABEL}=${OWNER_LABEL_VALUE}`, `${RUNNER_ID_LABEL}=${config.runnerId}`],
+    },
+  });
+
+  for (const volume of volumes ?? []) {
+    try {
+      await docker.getVolume(volume.Name).remove();
+      logger.info(`Removed leftover volume ${volume.Name}`);
+    } catch (error) {
+      logger.error(`Failed to remove leftover volume ${volume.Name}:`, error);
+    }
+  }
+
+  const prefix = `${config.runnerId}-`;
+  await removeLeftoverDirectories(config.workspaceDir, prefix);
+  await removeLeftoverDirectories(join(config.workspaceDir, 'deps'), prefix);
+};
+
+// The language label for a request's metrics and logs. Only registered names
+// are used, so requests can't add series of their own.
+const metricsLanguage = (request: ExecutionRequest): string => {
+  const name = request.language || detectLanguage(request.fileName ?? '');
+  return name && getLanguage(name) ? name : 'unknown';
+};
+
+const runSummary = (result: ExecutionResult | TestRunResult) =>
+  'cases' in result
+    ? { cases: result.cases.length, outcome: testRunOutcome(result) }
+    : { duration: result.duration, outcome: executionOutcome(result) };
+
+// Every call waits for a free slot before any Docker work starts, so at most
+// maxConcurrency runs (and their containers) exist at once. Waiting callers
+// give up their place in the queue if request.signal aborts.
+export const createRunner = (
+  docker: DockerClient,
+  config: RunnerConfig,
+  options: RunnerOptions = {}
+): Runner => {
+  const log = options.logger ?? noopLogger;
+  const slots = createSemaphore(options.maxConcurrency ?? config.concurrency);
+  const pool = options.pool ? createContainerPool(docker, config, options.pool, log) : undefined;
+
+  const metrics = options.metrics ? createExecutionMetrics(options.metrics) : undefined;
+  const cache = options.cache ? createResultCache(options.cache) : undefined;
+
+  // Every accepted call or open session, with what ends it if shutdown runs
+  // out of time.
+  const accepted = new Map<Promise<unknown>, () => void>();
+  let shuttingDown = false;
+
+  const record = (language: string, result?: ExecutionResult | TestRunResult) => {
+    if (result && 'cases' in result) {
+      metrics?.recordTestRun(language, result);
+    } else {
+      metrics?.record(language, result);
+    }
+  };
+
+  const instrumented = async <T extends ExecutionResult | TestRunResult>(
+    request: ExecutionRequest,
+    run: () => Promise<T>
+  ): Promise<T> => {
+    const language = metricsLanguage(request);
+    let result: T | undefined;
+    try {
+      result = await run();
+      log.info('Run finished', { language, ...runSummary(result) });
+      return result;
+    } catch (error) {
+      log.warn('Run failed', {
+        language,
+        error: error instanceof Error ? error.message : String(error),
+      });
+      throw error;
+    } finally {
+      record(language, result);
+    }
+  };
+
+  // The request passed on carries a signal that follows request.signal and
+  // can also be aborted by shutdown(). Connection failures anywhere in a run
+  // surface as DaemonUnreachableError.
+  const withSlot = <T>(
+    request: ExecutionRequest,
+    run: (request: ExecutionRequest) => Promise<T>
+  ): Promise<T> => {
+    if (shuttingDown) {
+      return Promise.reject(new ShuttingDownError());
+    }
+
+    const controller = new AbortController();
+    const onAbort = () => controller.abort(request.signal?.reason);
+    if (request.signal?.aborted) {
+      onAbort();
+    } else {
+      request.signal?.addEventListener('abort', onAbort, { once: true });
+    }
+    const scoped = { ...request, signal: controller.signal };
+
+    const call = (async () => {
+      await slots.acquire(scoped.signal);
+      try {
+        const result = await run(scoped);
+        // A run that shutdown killed can still resolve, looking like any
+        // other timeout.
+        if (controller.signal.reason instanceof ShuttingDownError) {
+          throw controller.signal.reason;
+        }
+        return result;
+      } catch (error) {
+        const reason = controller.signal.reason;
+        throw toRunnerError(reason instanceof ShuttingDownError ? reason : error);
+      } finally {
+        slots.release();
+      }
+    })();
+
+    accepted.set(call, () => controller.abort(new ShuttingDownError()));
+    return call.finally(() => {
+      accepted.delete(call);
+      request.signal?.removeEventListener('abort', onAbort);
+    });
+  };
+
+  const run = (request: ExecutionRequest) =>
+    withSlot(request, (scoped) =>
+      pool?.supports(scoped)
+        ? validate(docker, scoped, config).then(() => pool.execute(scoped))
+        : execute(docker, scoped, config, log)
+    );
+
+  // A cache hit takes no slot and starts no container. The cache is an
+  // optimisation, so a failing store only costs the lookup or the write.
+  const lookup = async (request: ExecutionRequest): Promise<ExecutionResult> => {
+    // A hit is refused during shutdown like any other call.
+    if (shuttingDown) {
+      throw new ShuttingDownError();
+    }
+
+    const key = cache?.key(request);
+    if (!cache || key === undefined) {
+      return run(request);
+    }
+
+    try {
+      const cached = await cache.get(key);
+      if (cached) {
+        log.debug('Cache hit', { language: request.language, key });
+        return cached;
+      }
+    } catch (error) {
+      logger.warn('Result cache lookup failed:', error);
+    }
+
+    const result = await run(request);
+    try {
+      await cache.set(key, result);
+    } catch (error) {
+      logger.warn('Result cache write failed:', error);
+    }
+    return result;
+  };
+
+  // Cache hits are recorded like any other run.
+  const executeOne = (request: ExecutionRequest) => instrumented(request, () => lookup(request));
+
+  return {
+    execute: executeOne,
+    executeBatch: (requests, signal) =>
+      Promise.allSettled(
+        requests.map((request) => {
+          const combined = anySignal([request.signal, signal]);
+          return executeOne({ ...request, signal: combined.signal }).finally(combined.dispose);
+        })
+      ),
+    executeStream: (request, streams) =>
+      instrumented(request, () =>
+        withSlot(request, (scoped) => executeStream(docker, scoped, config, streams, log))
+      ),
+    runTestCases: (request, cases, testOptions) =>
+      instrumented(request, () =>
+        withSlot(request, (scoped) => runTestCases(docker, scoped, config, cases, testOptions, log))
+      ),
+    validate: async (request) => {
+      if (shuttingDown) {
+        throw new ShuttingDownError();
+      }
+      try {
+        await validate(docker, request, config);
+      } catch (error) {
+        throw toRunnerError(error);
+      }
+    },
+    startSession: (language, sessionOptions = {}) => {
+      if (shuttingDown) {
+        return Promise.reject(new ShuttingDownError());
+      }
+
+      // Registered before the slot is taken, so that a shutdown starting while
+      // this waits, or while the container starts, still waits for the session
+      // and can end it.
+      const controller = new AbortController();
+      const { signal, dispose } = anySignal([sessionOptions.signal, controller.signal]);
+
+      const opened = (async (): Promise<Session> => {
+        await slots.acquire(signal);
+        try {
+          return await startSession(docker, language, config, { ...sessionOptions, signal });
+        } catch (error) {
+          slots.release();
+          throw toRunnerError(error);
+        }
+      })();
+
+      const ended = opened
+        .then((session) => session.closed.catch(() => {}).finally(() => slots.release()))
+        .catch(() => {})
+        .finally(() => {
+          dispose();
+          accepted.delete(ended);
+        });
+      accepted.set(ended, () => {
+        controller.abort(new ShuttingDownError());
+        void opened.then((session) => session.close()).catch(() => {});
+      });
+      return opened;
+    },
+    inFlight: slots.active,
+    queued: slots.waiting,
+    ping: async () => {
+      try {
+        await docker.ping();
+      } catch (error) {
+        throw toRunnerError(error);
+      }
+    },
+    shutdown: async (signal) => {
+      shuttingDown = true;
+
+      const drained = Promise.allSettled([...accepted.keys()]);
+      const abortAll = () => {
+        for (const abort of accepted.values()) {
+          abort();
+        }
+      };
+
+      if (signal?.aborted) {
+        abortAll();
+      } else {
+        signal?.addEventListener('abort', abortAll, { once: true });
+      }
+
+      try {
+        await drained;
+      } finally {
+        signal?.removeEventListener('abort', abortAll);
+      }
+      await pool?.close();
+    },
+    close: async () => {
+      await pool?.close();
+    },
+    pruneImages: async (keepLatest) => {
+      try {
+        return await pruneImages(docker, keepLatest);
+      } catch (error) {
+        throw toRunnerError(error);
+      }
+    },
+    cleanup: () => cleanup(docker, config),
+    cacheStats: () => cache?.stats() ?? { hits: 0, misses: 0 },
+  };
+};
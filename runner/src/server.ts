@@ -0,0 +1,186 @@
+import { createServer as createHttpServer, IncomingMessage, Server, ServerResponse } from 'http';
+import { Registry } from 'prom-client';
+import { z } from 'zod';
+import { RunnerConfig } from './config.js';
+import { logger } from './logger.js';
+import { Runner } from './runner.js';
+import {
+  DaemonUnreachableError,
+  ImageNotBuiltError,
+  InvalidRequestError,
+  SourceTooLargeError,
+  UnknownLanguageError,
+  isDaemonUnreachable,
+} from './errors.js';
+
+export interface ServerOptions {
+  // Upper bound on a whole HTTP request, including the queue wait for a slot.
+  requestTimeout?: number;
+  maxBodyBytes?: number;
+  // Served as GET /metrics when given.
+  metrics?: Registry;
+}
+
+const DEFAULT_REQUEST_TIMEOUT = 60000;
+const DEFAULT_MAX_BODY_BYTES = 1024 * 1024;
+
+const ExecuteSchema = z.object({
+  language: z.string().optional(),
+  file_name: z.string().optional(),
+  version: z.string().optional(),
+  source: z.string(),
+  stdin: z.string().optional(),
+  timeout_ms: z.number().int().positive().optional(),
+  memory_bytes: z.number().int().positive().optional(),
+  deterministic: z.boolean().optional(),
+});
+
+class HttpError extends Error {
+  constructor(public statusCode: number, message: string) {
+    super(message);
+    Object.setPrototypeOf(this, HttpError.prototype);
+  }
+}
+
+const sendJson = (res: ServerResponse, statusCode: number, body: unknown): void => {
+  if (res.headersSent) {
+    return;
+  }
+  const payload = JSON.stringify(body);
+  res.writeHead(statusCode, {
+    'Content-Type': 'application/json',
+    'Content-Length': Buffer.byteLength(payload),
+  });
+  res.end(payload);
+};
+
+const readBody = async (req: IncomingMessage, maxBytes: number): Promise<unknown> => {
+  const chunks: Buffer[] = [];
+  let size = 0;
+
+  for await (const chunk of req) {
+    size += chunk.length;
+    if (size > maxBytes) {
+      throw new HttpError(413, `Request body exceeds ${maxBytes} bytes`);
+    }
+    chunks.push(chunk);
+  }
+
+  try {
+    return JSON.parse(Buffer.concat(chunks).toString('utf-8'));
+  } catch (e) {
+    throw new HttpError(400, 'Request body is not valid JSON');
+  }
+};
+
+// Exposes the runner as a small JSON API for use as a standalone service:
+//   POST /execute  {language | file_name, version?, source, stdin?, timeout_ms?, memory_bytes?,
+//                   deterministic?}
+//   GET  /healthz  200 while the Docker daemon answers, 503 otherwise
+//   GET  /metrics  Prometheus metrics, when a registry is configured
+// Time and memory limits are capped at the runner's configured maximums. A
+// run is aborted when the request times out or the client goes away.
+export const createServer = (
+  runner: Runner,
+  config: RunnerConfig,
+  options: ServerOptions = {}
+): Server => {
+  const requestTimeout = options.requestTimeout ?? DEFAULT_REQUEST_TIMEOUT;
+  const maxBodyBytes = options.maxBodyBytes ?? DEFAULT_MAX_BODY_BYTES;
+
+  const handleExecute = async (req: IncomingMessage, res: ServerResponse) => {
+    const parsed = ExecuteSchema.safeParse(await readBody(req, maxBodyBytes));
+    if (!parsed.success) {
+      throw new HttpError(400, parsed.error.issues.map((issue) => issue.message).join('; '));
+    }
+
+    const body = parsed.data;
+
+    const controller = new AbortController();
+    const timer = setTimeout(() => controller.abort(), requestTimeout);
+    const onClose = () => {
+      if (!res.writableEnded) {
+        controller.abort();
+      }
+    };
+    res.on('close', onClose);
+
+    try {
+      const result = await runner.execute({
+        language: body.language,
+        fileName: body.file_name,
+        version: body.version,
+        code: body.source,
+        stdin: body.stdin,
+        timeout: Math.min(body.timeout_ms ?? config.maxExecutionTime, config.maxExecutionTime),
+        memoryLimitBytes: Math.min(body.memory_bytes ?? config.maxMemory, config.maxMemory),
+        deterministic: body.deterministic,
+        signal: controller.signal,
+      });
+      // An aborted run usually still resolves, with the program killed part
+      // way through; that is answered as a timeout, not as its result.
+      controller.signal.throwIfAborted();
+      sendJson(res, 200, result);
+    } catch (error) {
+      if (controller.signal.aborted) {
+        throw new HttpError(504, 'Execution did not finish within the request timeout');
+      }
+      throw error;
+    } finally {
+      clearTimeout(timer);
+      res.off('close', onClose);
+    }
+  };
+
+  const handleHealth = async (res: ServerResponse) => {
+    try {
+      await runner.ping();
+      sendJson(res, 200, { status: 'ok' });
+    } catch (error) {
+      sendJson(res, 503, { status: 'unavailable', error: 'Docker daemon is unreachable' });
+    }
+  };
+
+  const server = createHttpServer(async (req, res) => {
+    try {
+      const path = new URL(req.url ?? '/', 'http://localhost').pathname;
+
+      if (path === '/execute') {
+        if (req.method !== 'POST') {
+          throw new HttpError(405, 'Method not allowed');
+        }
+        await handleExecute(req, res);
+      } else if (path === '/healthz') {
+        await handleHealth(res);
+      } else if (path === '/metrics' && options.metrics) {
+        const metrics = await options.metrics.metrics();
+        res.writeHead(200, { 'Content-Type': options.metrics.contentType });
+        res.end(metrics);
+      } else {
+        throw new HttpError(404, 'Not found');
+      }
+    } catch (error) {
+      if (error instanceof HttpError) {
+        sendJson(res, error.statusCode, { error: error.message });
+      } else if (error instanceof SourceTooLargeError) {
+        sendJson(res, 413, { error: error.message });
+      } else if (error instanceof UnknownLanguageError || error instanceof InvalidRequestError) {
+        sendJson(res, 400, { error: error.message });
+      } else if (error instanceof ImageNotBuiltError) {
+        // Not the client's fault: the runner needs its image built first.
+        sendJson(res, 503, { error: error.message });
+      } else if (error instanceof DaemonUnreachableError || isDaemonUnreachable(error)) {
+        sendJson(res, 503, { error: 'Docker daemon is unreachable' });
+      } else {
+        logger.error('Execute request failed:', error);
+        sendJson(res, 500, { error: 'Internal server error' });
+      }
+    }
+  });
+
+  // Slightly longer than the run timeout so the handler can still answer 504.
+  server.requestTimeout = requestTimeout + 5000;
+  server.headersTimeout = Math.min(server.requestTimeout, 60000);
+
+  return server;
+};
@@ -0,0 +1,248 @@
+import Docker from 'dockerode';
+import { Writable } from 'stream';
+import { chmod, mkdir, mkdtemp, rm } from 'fs/promises';
+import { join } from 'path';
+import { RunnerConfig } from './config.js';
+import { DockerClient } from './docker.js';
+import { getLanguage, listLanguages, listVersions } from './languages.js';
+import { ensureImage, runnerLabels } from './images.js';
+import {
+  ImageNotBuiltError,
+  InvalidRequestError,
+  UnknownLanguageError,
+  WorkspaceSetupError,
+  isImageNotFound,
+} from './errors.js';
+import {
+  buildEnv,
+  createOutputLimit,
+  defaultSandbox,
+  exitSignal,
+  sandboxHostConfig,
+  DEFAULT_MAX_OUTPUT_BYTES,
+} from './executor.js';
+
+export interface SessionOptions {
+  version?: string;
+  // Lifetime of the whole session, after which the process is killed.
+  timeout?: number;
+  // Combined stdout and stderr for the session; exceeding it ends it.
+  maxOutputBytes?: number;
+  signal?: AbortSignal;
+}
+
+export type SessionEvent =
+  | { type: 'stdout' | 'stderr'; data: Buffer }
+  | { type: 'exit'; exitCode: number; signal?: string; timedOut: boolean; oomKilled: boolean };
+
+export interface Session {
+  send: (data: string | Buffer) => void;
+  // Output as it arrives, ending with a single exit event once the process is
+  // gone, whether it exited by itself or the session was closed. Meant for
+  // one consumer.
+  output: AsyncIterable<SessionEvent>;
+  // Resolves when the process has ended and its container is removed.
+  closed: Promise<void>;
+  close: () => Promise<void>;
+}
+
+const DEFAULT_SESSION_TIMEOUT = 10 * 60 * 1000;
+
+const createEventQueue = () => {
+  const events: SessionEvent[] = [];
+  let ended = false;
+  let wake: (() => void) | undefined;
+
+  const notify = () => {
+    wake?.();
+    wake = undefined;
+  };
+
+  return {
+    push: (event: SessionEvent) => {
+      events.push(event);
+      notify();
+    },
+    end: () => {
+      ended = true;
+      notify();
+    },
+    iterable: {
+      [Symbol.asyncIterator]: async function* () {
+        while (true) {
+          const event = events.shift();
+          if (event) {
+            yield event;
+          } else if (ended) {
+            return;
+          } else {
+            await new Promise<void>((resolve) => {
+              wake = resolve;
+            });
+          }
+        }
+      },
+    } as AsyncIterable<SessionEvent>,
+  };
+};
+
+// Starts the language's interactive interpreter in a long-lived container and
+// keeps stdin open, so input can be sent over time and output read between
+// sends. The sandbox is the same as for a run with default limits.
+export const startSession = async (
+  docker: DockerClient,
+  name: string,
+  config: RunnerConfig,
+  options: SessionOptions = {}
+): Promise<Session> => {
+  if (!getLanguage(name)) {
+    throw new UnknownLanguageError(name, undefined, listLanguages());
+  }
+
+  const language = getLanguage(name, options.version);
+  if (!language) {
+    throw new UnknownLanguageError(name, options.version, listVersions(name));
+  }
+  if (!language.replCommand) {
+    throw new InvalidRequestError(`Language ${name} has no interactive mode`);
+  }
+
+  options.signal?.throwIfAborted();
+
+  const image = await ensureImage(
+    docker,
+    name,
+    language.version,
+    undefined,
+    config.autoBuildImages
+  );
+  const sandbox = await defaultSandbox(config);
+
+  let workspace: string;
+  try {
+    await mkdir(config.workspaceDir, { recursive: true });
+    workspace = await mkdtemp(join(config.workspaceDir, `${config.runnerId}-session-`));
+    await chmod(workspace, 0o777);
+  } catch (error) {
+    throw new WorkspaceSetupError(error);
+  }
+
+  let container: Docker.Container | undefined;
+  try {
+    container = await docker.createContainer({
+      Image: image,
+      Cmd: language.replCommand,
+      HostConfig: sandboxHostConfig({ ...sandbox, workspace, binds: [] }),
+      Labels: runnerLabels(config),
+      Env: buildEnv({ language: name }),
+      WorkingDir: '/workspace',
+      AttachStdin: true,
+      AttachStdout: true,
+      AttachStderr: true,
+      OpenStdin: true,
+      StdinOnce: false,
+    });
+  } catch (error) {
+    await rm(workspace, { recursive: true, force: true });
+    throw isImageNotFound(error) ? new ImageNotBuiltError(name, image) : error;
+  }
+
+  const running = container;
+  const queue = createEventQueue();
+  let timedOut = false;
+
+  const kill = async () => {
+    try {
+      await running.kill({ signal: 'SIGKILL' });
+    } catch (e) {}
+  };
+
+  const outputLimit = createOutputLimit(options.maxOutputBytes ?? DEFAULT_MAX_OUTPUT_BYTES, kill);
+  const forward = (type: 'stdout' | 'stderr') =>
+    new Writable({
+      write(chunk: Buffer, _encoding, callback) {
+        const allowed = outputLimit.take(chunk.length);
+        if (allowed > 0) {
+          queue.push({ type, data: Buffer.from(chunk.subarray(0, allowed)) });
+        }
+        callback();
+      },
+    });
+
+  let stream: NodeJS.ReadWriteStream;
+  try {
+    stream = await running.attach({
+      stream: true,
+      stdin: true,
+      stdout: true,
+      stderr: true,
+      hijack: true,
+    });
+    docker.modem.demuxStream(stream, forward('stdout'), forward('stderr'));
+    await running.start();
+  } catch (error) {
+    try {
+      await running.remove({ force: true });
+    } catch (e) {}
+    await rm(workspace, { recursive: true, force: true });
+    throw error;
+  }
+
+  const streamClosed = new Promise<void>((resolve) => {
+    stream.on('end', resolve);
+    stream.on('close', resolve);
+    stream.on('error', () => resolve());
+  });
+
+  const expire = () => {
+    timedOut = true;
+    kill();
+  };
+  const timer = setTimeout(expire, options.timeout ?? DEFAULT_SESSION_TIMEOUT);
+  options.signal?.addEventListener('abort', kill, { once: true });
+
+  const closed = (async () => {
+    try {
+      await running.wait();
+      await streamClosed;
+
+      let exitCode = 137;
+      let oomKilled = false;
+      try {
+        const info = await running.inspect();
+        exitCode = info.State.ExitCode;
+        oomKilled = info.State.OOMKilled;
+      } catch (e) {}
+
+      queue.push({ type: 'exit', exitCode, signal: exitSignal(exitCode), timedOut, oomKilled });
+    } finally {
+      clearTimeout(timer);
+      options.signal?.removeEventListener('abort', kill);
+      queue.end();
+      try {
+        await running.remove({ force: true });
+      } catch (e) {}
+      await rm(workspace, { recursive: true, force: true });
+    }
+  })();
+
+  let ended = false;
+  closed.finally(() => {
+    ended = true;
+  }).catch(() => {});
+
+  return {
+    send: (data) => {
+      if (ended) {
+        throw new InvalidRequestError('Session has ended');
+      }
+      stream.write(data);
+    },
+    output: queue.iterable,
+    closed,
+    close: async () => {
+      await kill();
+      await closed;
+    },
+  };
+};
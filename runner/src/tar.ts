@@ -0,0 +1,44 @@
+const BLOCK_SIZE = 512;
+
+const writeOctal = (header: Buffer, value: number, offset: number, length: number) => {
+  header.write(value.toString(8).padStart(length - 1, '0') + '\0', offset, length, 'ascii');
+};
+
+// Builds an uncompressed ustar archive in memory. Used for image build
+// contexts, which only ever hold a handful of small files.
+export const createTar = (files: Record<string, string | Buffer>): Buffer => {
+  const blocks: Buffer[] = [];
+  const mtime = Math.floor(Date.now() / 1000);
+
+  for (const [name, contents] of Object.entries(files)) {
+    const data = Buffer.isBuffer(contents) ? contents : Buffer.from(contents);
+    const header = Buffer.alloc(BLOCK_SIZE);
+
+    header.write(name, 0, 100, 'utf-8');
+    writeOctal(header, 0o644, 100, 8);
+    writeOctal(header, 0, 108, 8);
+    writeOctal(header, 0, 116, 8);
+    writeOctal(header, data.length, 124, 12);
+    writeOctal(header, mtime, 136, 12);
+    header.fill(' ', 148, 156);
+    header.write('0', 156, 'ascii');
+    header.write('ustar\0', 257, 'ascii');
+    header.write('00', 263, 'ascii');
+
+    let checksum = 0;
+    for (const byte of header) {
+      checksum += byte;
+    }
+    header.write(checksum.toString(8).padStart(6, '0') + '\0 ', 148, 8, 'ascii');
+
+    blocks.push(header, data);
+
+    const padding = (BLOCK_SIZE - (data.length % BLOCK_SIZE)) % BLOCK_SIZE;
+    if (padding > 0) {
+      blocks.push(Buffer.alloc(padding));
+    }
+  }
+
+  blocks.push(Buffer.alloc(BLOCK_SIZE * 2));
+  return Buffer.concat(blocks);
+};
@@ -0,0 +1,81 @@
+import { test } from 'node:test';
+import assert from 'node:assert/strict';
+import {
+  DaemonUnreachableError,
+  ImageBuildError,
+  ImageNotBuiltError,
+  InvalidRequestError,
+  RunnerError,
+  ShuttingDownError,
+  SourceTooLargeError,
+  UnknownLanguageError,
+  WorkspaceSetupError,
+  isImageNotFound,
+  toRunnerError,
+} from '../src/errors.js';
+
+const refused = Object.assign(new Error('connect ECONNREFUSED /var/run/docker.sock'), {
+  code: 'ECONNREFUSED',
+  syscall: 'connect',
+});
+
+test('every typed error is a RunnerError named after its class', () => {
+  const errors: RunnerError[] = [
+    new UnknownLanguageError('cobol', undefined, ['python']),
+    new InvalidRequestError('bad path'),
+    new DaemonUnreachableError(refused),
+    new ImageBuildError('codecontest/python-runner:abc', 'log'),
+    new ImageNotBuiltError('python', 'codecontest/python-runner:abc'),
+    new SourceTooLargeError(2048, 1024),
+    new WorkspaceSetupError(new Error('ENOSPC')),
+    new ShuttingDownError(),
+  ];
+
+  for (const error of errors) {
+    assert.ok(error instanceof RunnerError);
+    assert.equal(error.name, error.constructor.name);
+  }
+});
+
+test('typed errors keep the details callers need', () => {
+  const unknown = new UnknownLanguageError('python', '2.7', ['3.12']);
+  assert.equal(unknown.message, 'Unsupported version 2.7 of python (available: 3.12)');
+
+  assert.equal(new DaemonUnreachableError(refused).cause, refused);
+
+  const notBuilt = new ImageNotBuiltError('python', 'codecontest/python-runner:abc');
+  assert.equal(notBuilt.language, 'python');
+  assert.equal(notBuilt.image, 'codecontest/python-runner:abc');
+
+  assert.equal(new SourceTooLargeError(2048, 1024, 'main.py').file, 'main.py');
+  assert.equal(new SourceTooLargeError(2048, 1024).file, undefined);
+
+  const cause = new Error('ENOSPC');
+  assert.match(new WorkspaceSetupError(cause).message, /ENOSPC/);
+  assert.equal(new ImageBuildError('image', 'log', cause).buildLog, 'log');
+});
+
+test('connection failures become DaemonUnreachableError, anything else is left alone', () => {
+  const converted = toRunnerError(refused);
+  assert.ok(converted instanceof DaemonUnreachableError);
+  assert.equal(converted.cause, refused);
+
+  const missingSocket = Object.assign(new Error('connect ENOENT'), {
+    code: 'ENOENT',
+    syscall: 'connect',
+  });
+  assert.ok(toRunnerError(missingSocket) instanceof DaemonUnreachableError);
+
+  const ours = new ShuttingDownError();
+  assert.equal(toRunnerError(ours), ours);
+
+  const other = Object.assign(new Error('conflict'), { statusCode: 409 });
+  assert.equal(toRunnerError(other), other);
+});
+
+test('only a 404 means the image is missing', () => {
+  assert.equal(isImageNotFound(Object.assign(new Error('no such image'), { statusCode: 404 })), true);
+  assert.equal(isImageNotFound(Object.assign(new Error('server error'), { statusCode: 500 })), false);
+  assert.equal(isImageNotFound(refused), false);
+  assert.equal(isImageNotFound(undefined), false);
+});
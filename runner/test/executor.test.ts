@@ -0,0 +1,443 @@
+import { test, after } from 'node:test';
+import assert from 'node:assert/strict';
+import { once } from 'events';
+import { existsSync } from 'fs';
+import { mkdir, rm, symlink, writeFile } from 'fs/promises';
+import { join } from 'path';
+import { InvalidRequestError, SourceTooLargeError, UnknownLanguageError } from '../src/errors.js';
+import {
+  buildEnv,
+  createCollector,
+  createOutputLimit,
+  execute,
+  exitSignal,
+  runTestCases,
+  validate,
+} from '../src/executor.js';
+import { createFakeDocker, createTestConfig } from './fake-docker.js';
+
+const config = await createTestConfig();
+const limited = await createTestConfig({ maxSourceBytes: 100, maxSourceFileBytes: 60 });
+
+after(async () => {
+  await rm(config.workspaceDir, { recursive: true, force: true });
+  await rm(limited.workspaceDir, { recursive: true, force: true });
+});
+
+test('file paths that leave the workspace are rejected', async () => {
+  const fake = createFakeDocker();
+
+  for (const path of ['../../etc/passwd', '/etc/passwd', 'pkg/../../main.go', '..', '']) {
+    await assert.rejects(
+      validate(fake.docker, { language: 'go', files: { [path]: 'package main' } }, config),
+      InvalidRequestError,
+      path
+    );
+    await assert.rejects(
+      validate(fake.docker, { language: 'python', code: '', outputFiles: [path] }, config),
+      InvalidRequestError,
+      path
+    );
+  }
+  assert.equal(fake.created.length, 0);
+});
+
+test('every file of a multi-file submission is written before the build', async () => {
+  const seen: string[][] = [];
+  const fake = createFakeDocker({
+    run: ({ workspace }) => {
+      seen.push(['main.go', 'util/util.go'].filter((path) => existsSync(join(workspace!, path))));
+      return {};
+    },
+  });
+
+  await execute(
+    fake.docker,
+    {
+      language: 'go',
+      files: {
+        'main.go': 'package main\n\nimport "example/util"\n\nfunc main() { util.Hello() }\n',
+        'go.mod': 'module example\n\ngo 1.21\n',
+        'util/util.go': 'package util\n\nfunc Hello() {}\n',
+      },
+    },
+    config
+  );
+
+  assert.equal(fake.created.length, 2);
+  assert.deepEqual(seen, [
+    ['main.go', 'util/util.go'],
+    ['main.go', 'util/util.go'],
+  ]);
+});
+
+test('a Java submission is named after its public class', async () => {
+  const commands: string[][] = [];
+  const fake = createFakeDocker({
+    run: ({ options, workspace }) => {
+      commands.push(options.Cmd as string[]);
+      assert.ok(existsSync(join(workspace!, 'Solution.java')));
+      return {};
+    },
+  });
+
+  await execute(
+    fake.docker,
+    {
+      language: 'java',
+      code: 'public class Solution {\n  public static void main(String[] args) {}\n}\n',
+    },
+    config
+  );
+
+  assert.equal(commands.length, 2);
+  assert.equal(commands[1].at(-1), 'Solution');
+});
+
+test('output files are returned, and links are refused', async () => {
+  const fake = createFakeDocker({
+    run: async ({ workspace }) => {
+      await writeFile(join(workspace!, 'out.txt'), 'result');
+      await symlink('/etc/passwd', join(workspace!, 'passwd'));
+      await mkdir(join(workspace!, 'out'));
+      await symlink('/etc', join(workspace!, 'out', 'etc'));
+      return {};
+    },
+  });
+
+  const result = await execute(
+    fake.docker,
+    { language: 'python', code: '', outputFiles: ['out.txt', 'passwd', 'out/etc/hostname', 'gone'] },
+    config
+  );
+
+  assert.deepEqual(result.outputFiles, { 'out.txt': Buffer.from('result') });
+  assert.deepEqual(result.outputFileErrors, {
+    passwd: 'not a regular file',
+    'out/etc/hostname': 'not a regular file',
+    gone: 'not found',
+  });
+});
+
+// Which containers got which environment, split by whether they install.
+const recordEnv = (isInstall: (command: string[]) => boolean) => {
+  const installs: string[][] = [];
+  const runs: string[][] = [];
+  const fake = createFakeDocker({
+    run: ({ options }) => {
+      (isInstall(options.Cmd as string[]) ? installs : runs).push(options.Env ?? []);
+      return {};
+    },
+  });
+  return { fake, installs, runs };
+};
+
+test('an npm install gets none of the request env', async () => {
+  const { fake, installs, runs } = recordEnv((command) => command[0] === 'npm');
+
+  await execute(
+    fake.docker,
+    {
+      language: 'javascript',
+      code: '',
+      dependencies: ['lodash'],
+      env: { npm_config_registry: 'https://registry.example' },
+    },
+    { ...config, networkDisabled: false }
+  );
+
+  assert.equal(installs.length, 1);
+  assert.ok(!installs[0].some((entry) => entry.startsWith('npm_config_registry=')));
+  assert.ok(runs[0].includes('npm_config_registry=https://registry.example'));
+});
+
+test('a bundle install gets none of the request env', async () => {
+  const { fake, installs } = recordEnv((command) => command.join(' ').includes('bundle install'));
+
+  await execute(
+    fake.docker,
+    {
+      language: 'ruby',
+      code: '',
+      dependencies: ['rake@~>13.0'],
+      env: { BUNDLE_MIRROR__ALL: 'https://mirror.example' },
+    },
+    { ...config, networkDisabled: false }
+  );
+
+  assert.equal(installs.length, 1);
+  assert.ok(!installs[0].some((entry) => entry.startsWith('BUNDLE_MIRROR__ALL=')));
+});
+
+test('fetching Go imports gets none of the request env', async () => {
+  const { fake, installs, runs } = recordEnv((command) => command.join(' ').includes('go mod tidy'));
+
+  await execute(
+    fake.docker,
+    {
+      language: 'go',
+      code: 'package main\n\nfunc main() {}\n',
+      env: { GOPROXY: 'https://proxy.example', GOFLAGS: '-insecure' },
+    },
+    { ...config, networkDisabled: false, buildCacheVolumes: true }
+  );
+
+  assert.equal(installs.length, 1);
+  assert.ok(installs[0].includes('GOMODCACHE=/cache/go/mod'));
+  assert.ok(!installs[0].some((entry) => /^(GOPROXY|GOFLAGS)=/.test(entry)));
+  assert.ok(runs.at(-1)!.includes('GOPROXY=https://proxy.example'));
+});
+
+test('stdout and stderr share one output limit, cut at the exact byte', async () => {
+  let exceeded = 0;
+  const limit = createOutputLimit(10, () => exceeded++);
+  const stdout = createCollector(limit);
+  const stderr = createCollector(limit);
+
+  stdout.stream.write('123456');
+  stderr.stream.write('7890');
+  assert.equal(limit.truncated(), false);
+  assert.equal(exceeded, 0);
+
+  stdout.stream.write('x');
+  stderr.stream.write('yz');
+  stdout.stream.end();
+  stderr.stream.end();
+  await Promise.all([once(stdout.stream, 'finish'), once(stderr.stream, 'finish')]);
+
+  assert.equal(stdout.text(), '123456');
+  assert.equal(stderr.text(), '7890');
+  assert.equal(limit.truncated(), true);
+  assert.equal(exceeded, 1);
+});
+
+test('test cases share one build and trailing whitespace can be ignored', async () => {
+  const fake = createFakeDocker({
+    // Echoes stdin, with trailing spaces on the second case only.
+    run: ({ options, stdin }) =>
+      (options.Cmd as string[]).join(' ').includes('gcc')
+        ? {}
+        : { stdout: stdin === '2' ? '2  \n' : `${stdin}\n` },
+  });
+  const cases = [
+    { stdin: '1', expectedStdout: '1\n' },
+    { stdin: '2', expectedStdout: '2\n' },
+    { stdin: '3', expectedStdout: '4\n' },
+  ];
+  const request = { language: 'c', code: 'int main(void) { return 0; }\n' };
+
+  const strict = await runTestCases(fake.docker, request, config, cases);
+  assert.deepEqual(
+    strict.cases.map((result) => result.passed),
+    [true, false, false]
+  );
+  assert.equal(fake.created.length, 1 + cases.length);
+
+  const lenient = await runTestCases(fake.docker, request, config, cases, {
+    ignoreTrailingWhitespace: true,
+  });
+  assert.deepEqual(
+    lenient.cases.map((result) => result.passed),
+    [true, true, false]
+  );
+  assert.equal(fake.created.length, 2 * (1 + cases.length));
+});
+
+test('args reach the program as they are, without a shell', async () => {
+  const fake = createFakeDocker();
+
+  await execute(
+    fake.docker,
+    { language: 'python', code: '', args: ['hello world', '$(whoami)'] },
+    config
+  );
+
+  // The memory-measuring wrapper hands them on as "$@".
+  const command = fake.created[0].Cmd as string[];
+  assert.deepEqual(command.slice(command.indexOf('python3')), [
+    'python3',
+    'main.py',
+    'hello world',
+    '$(whoami)',
+  ]);
+});
+
+test('request env is added over the defaults, except for protected names', () => {
+  const env = buildEnv({
+    language: 'python',
+    code: '',
+    env: { GREETING: 'hello', TZ: 'Europe/Paris' },
+  });
+  assert.ok(env.includes('GREETING=hello'));
+  assert.ok(env.includes('TZ=Europe/Paris'));
+  assert.ok(!env.includes('TZ=UTC'));
+  assert.ok(env.includes('LANG=C.UTF-8'));
+
+  assert.throws(
+    () => buildEnv({ language: 'python', code: '', env: { PATH: '/tmp' } }),
+    InvalidRequestError
+  );
+  const unsafe = buildEnv({
+    language: 'python',
+    code: '',
+    env: { PATH: '/tmp' },
+    allowUnsafeEnv: true,
+  });
+  assert.ok(unsafe.includes('PATH=/tmp'));
+});
+
+test('the warnings of a successful compile are kept', async () => {
+  const warning = "main.c:1:5: warning: unused variable 'x'\n";
+  const fake = createFakeDocker({
+    run: ({ options }) => {
+      const compiling = (options.Cmd as string[]).join(' ').includes('gcc');
+      return compiling ? { stderr: warning } : { stdout: 'ok\n' };
+    },
+  });
+
+  const result = await execute(
+    fake.docker,
+    { language: 'c', code: 'int main(void) { int x; return 0; }\n' },
+    config
+  );
+
+  assert.equal(result.stdout, 'ok\n');
+  assert.equal(result.compileError, undefined);
+  assert.equal(result.compileOutput, warning);
+});
+
+test('exit codes above 128 are named after the signal', () => {
+  assert.equal(exitSignal(139), 'SIGSEGV');
+  assert.equal(exitSignal(134), 'SIGABRT');
+  assert.equal(exitSignal(137), 'SIGKILL');
+  assert.equal(exitSignal(1), undefined);
+  assert.equal(exitSignal(128), undefined);
+});
+
+test('validate accepts a good request and rejects what a run would', async () => {
+  const fake = createFakeDocker();
+
+  await assert.doesNotReject(validate(fake.docker, { language: 'python', code: 'print(1)' }, config));
+  await assert.rejects(
+    validate(fake.docker, { language: 'brainfork', code: '' }, config),
+    UnknownLanguageError
+  );
+  await assert.rejects(
+    validate(fake.docker, { language: 'python', version: '2.7', code: '' }, config),
+    UnknownLanguageError
+  );
+
+  for (const limits of [
+    { timeout: 0 },
+    { timeout: config.maxExecutionTime + 1 },
+    { memoryLimitBytes: 1024 },
+    { memoryLimitBytes: config.maxMemory + 1 },
+    { pidsLimit: 1.5 },
+    { cpuLimit: 0 },
+    { maxOutputBytes: -1 },
+  ]) {
+    await assert.rejects(
+      validate(fake.docker, { language: 'python', code: '', ...limits }, config),
+      InvalidRequestError,
+      JSON.stringify(limits)
+    );
+  }
+  assert.equal(fake.created.length, 0);
+});
+
+test('root is refused as the user unless allowRootUser is set', async () => {
+  const fake = createFakeDocker();
+
+  for (const user of ['root', '0', '1000:0', '00', 'nobody:root']) {
+    await assert.rejects(
+      validate(fake.docker, { language: 'python', code: '', user }, config),
+      InvalidRequestError,
+      user
+    );
+    await assert.doesNotReject(
+      validate(fake.docker, { language: 'python', code: '', user, allowRootUser: true }, config)
+    );
+  }
+  await assert.rejects(
+    validate(fake.docker, { language: 'python', code: '', user: '1000; rm -rf /' }, config),
+    InvalidRequestError
+  );
+  await assert.doesNotReject(
+    validate(fake.docker, { language: 'python', code: '', user: '1000:1000' }, config)
+  );
+});
+
+test('the requested user is the one the container runs as', async () => {
+  const fake = createFakeDocker();
+
+  await execute(fake.docker, { language: 'python', code: '', user: '1000:1000' }, config);
+
+  assert.equal(fake.created[0].User, '1000:1000');
+});
+
+test('a compile that runs out of time is reported as a compile error', async () => {
+  const fake = createFakeDocker({
+    // The compiler never finishes; the runner has to kill it.
+    run: ({ options }) =>
+      (options.Cmd as string[]).join(' ').includes('gcc') ? new Promise(() => {}) : {},
+  });
+
+  const result = await execute(
+    fake.docker,
+    { language: 'c', code: 'int main(void) { return 0; }\n', compileTimeout: 20 },
+    config
+  );
+
+  assert.match(result.compileError ?? '', /^Compilation timed out after 20ms/);
+  assert.equal(fake.created.length, 1);
+});
+
+test('deterministic runs pin their variables per language', () => {
+  const python = buildEnv({ language: 'python', code: '', deterministic: true });
+  assert.ok(python.includes('PYTHONHASHSEED=0'));
+  assert.ok(python.includes('SOURCE_DATE_EPOCH=0'));
+  assert.ok(!python.some((entry) => entry.startsWith('GODEBUG=')));
+
+  const go = buildEnv({ language: 'go', code: '', deterministic: true });
+  assert.ok(go.includes('GODEBUG=randautoseed=0'));
+  assert.ok(!go.some((entry) => entry.startsWith('PYTHONHASHSEED=')));
+
+  assert.ok(!buildEnv({ language: 'python', code: '' }).includes('PYTHONHASHSEED=0'));
+
+  for (const env of [
+    { PYTHONHASHSEED: '1' },
+    { SOURCE_DATE_EPOCH: '1700000000' },
+    { TZ: 'Asia/Tokyo' },
+  ]) {
+    assert.throws(
+      () => buildEnv({ language: 'python', code: '', deterministic: true, env }),
+      InvalidRequestError,
+      JSON.stringify(env)
+    );
+  }
+});
+
+test('source over the per-file or total limit is refused before any container', async () => {
+  const fake = createFakeDocker();
+  const tooLarge = (file: string | undefined) => (error: unknown) => {
+    assert.ok(error instanceof SourceTooLargeError);
+    assert.equal(error.file, file);
+    return true;
+  };
+
+  await execute(fake.docker, { language: 'python', code: 'x'.repeat(60) }, limited);
+  await assert.rejects(
+    execute(fake.docker, { language: 'python', code: 'x'.repeat(61) }, limited),
+    tooLarge('main.py')
+  );
+
+  const files = (size: number) => ({ 'a.py': 'x'.repeat(50), 'b.py': 'x'.repeat(size) });
+  await execute(fake.docker, { language: 'python', code: '', files: files(50) }, limited);
+  await assert.rejects(
+    execute(fake.docker, { language: 'python', code: '', files: files(51) }, limited),
+    tooLarge(undefined)
+  );
+
+  // Only the two runs within the limits got a container.
+  assert.equal(fake.created.length, 2);
+});
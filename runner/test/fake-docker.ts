@@ -0,0 +1,244 @@
+import { Duplex, PassThrough, Writable } from 'stream';
+import { mkdtemp } from 'fs/promises';
+import { tmpdir } from 'os';
+import { join } from 'path';
+import Docker from 'dockerode';
+import { RunnerConfig } from '../src/config.js';
+import { DockerClient } from '../src/docker.js';
+
+// What a fake container is given when it runs: its create options, the host
+// directory mounted at /workspace, if any, and everything written to stdin.
+export interface FakeRun {
+  options: Docker.ContainerCreateOptions;
+  workspace?: string;
+  stdin: string;
+}
+
+export interface FakeOutcome {
+  stdout?: string;
+  stderr?: string;
+  exitCode?: number;
+}
+
+type Labels = Record<string, string>;
+type ListOptions = { filters?: { label?: string[] } };
+
+// What the daemon already has, as its list calls report it.
+export interface FakeListing {
+  containers?: Array<{ Id: string; ImageID?: string; Labels?: Labels }>;
+  images?: Array<{ Id: string; Created: number; RepoTags?: string[]; Labels?: Labels }>;
+  volumes?: Array<{ Name: string; Labels?: Labels }>;
+}
+
+export interface FakeDockerOptions {
+  // Tags that inspect finds; every build adds its own.
+  images?: string[];
+  // Decides the output of each container. Defaults to a clean exit.
+  run?: (run: FakeRun) => FakeOutcome | Promise<FakeOutcome>;
+  // Fails createContainer with the returned error, when there is one.
+  createError?: (options: Docker.ContainerCreateOptions) => unknown;
+  listing?: FakeListing;
+}
+
+export interface FakeDocker {
+  docker: DockerClient;
+  // Tags the daemon has; removing one makes it go missing.
+  images: Set<string>;
+  // Options of every container created, in order.
+  created: Docker.ContainerCreateOptions[];
+  // Tags of every image built, in order.
+  built: string[];
+  // Ids of the containers and images, and names of the volumes, removed
+  // through getContainer, getImage and getVolume, in order.
+  removed: { containers: string[]; images: string[]; volumes: string[] };
+}
+
+export const notFound = (message: string): Error =>
+  Object.assign(new Error(message), { statusCode: 404 });
+
+const hostWorkspace = (options: Docker.ContainerCreateOptions): string | undefined => {
+  const bind = options.HostConfig?.Binds?.find((bind) => bind.endsWith(':/workspace:rw'));
+  return bind?.slice(0, -':/workspace:rw'.length);
+};
+
+// Whether labels satisfy every label=value (or bare label) filter given.
+const matchesLabels = (labels: Labels = {}, options?: ListOptions): boolean =>
+  (options?.filters?.label ?? []).every((filter) => {
+    const [name, value] = filter.split('=');
+    return value === undefined ? name in labels : labels[name] === value;
+  });
+
+// A Docker client whose containers never run anything: once stdin is closed,
+// options.run decides what the container printed and how it exited. Commands
+// exec'd into a started container go through options.run too, with the
+// exec's Cmd and Env in place of the container's. Killing a container ends
+// whatever it is running with exit code 137.
+export const createFakeDocker = (options: FakeDockerOptions = {}): FakeDocker => {
+  const images = new Set(options.images);
+  const created: Docker.ContainerCreateOptions[] = [];
+  const built: string[] = [];
+  const listing = {
+    containers: [...(options.listing?.containers ?? [])],
+    images: [...(options.listing?.images ?? [])],
+    volumes: [...(options.listing?.volumes ?? [])],
+  };
+  const removed: FakeDocker['removed'] = { containers: [], images: [], volumes: [] };
+  const outputs = new WeakMap<NodeJS.ReadableStream, { stdout: Writable; stderr: Writable }>();
+
+  // An attached stream: collects what is written to it until it is ended,
+  // then runs the command and sends its output back demultiplexed.
+  const attached = (runOptions: Docker.ContainerCreateOptions) => {
+    const input: Buffer[] = [];
+    const stream = new Duplex({
+      write: (chunk, _encoding, callback) => {
+        input.push(Buffer.from(chunk));
+        callback();
+      },
+      read: () => {},
+    });
+    let kill = () => {};
+    const killed = new Promise<FakeOutcome>((resolve) => {
+      kill = () => resolve({ exitCode: 137 });
+    });
+    const ran = new Promise((resolve) => stream.once('finish', resolve)).then(
+      async () =>
+        (await options.run?.({
+          options: runOptions,
+          workspace: hostWorkspace(runOptions),
+          stdin: Buffer.concat(input).toString(),
+        })) ?? {}
+    );
+    // A kill ends the command where it is, whatever run would have returned.
+    const finished = Promise.race([ran, killed]).then((outcome) => {
+      const sinks = outputs.get(stream);
+      if (outcome.stdout) {
+        sinks?.stdout.write(outcome.stdout);
+      }
+      if (outcome.stderr) {
+        sinks?.stderr.write(outcome.stderr);
+      }
+      stream.push(null);
+      return outcome.exitCode ?? 0;
+    });
+    return { stream, finished, kill };
+  };
+
+  const createContainer = async (createOptions: Docker.ContainerCreateOptions) => {
+    const error = options.createError?.(createOptions);
+    if (error) {
+      throw error;
+    }
+    created.push(createOptions);
+
+    const { stream, finished, kill } = attached(createOptions);
+    const execs: Array<() => void> = [];
+    let running = false;
+    let exitCode = 0;
+
+    return {
+      id: `fake-${created.length}`,
+      attach: async () => stream,
+      start: async () => {
+        running = true;
+      },
+      wait: async () => {
+        exitCode = await finished;
+        running = false;
+        return { StatusCode: exitCode };
+      },
+      exec: async (execOptions: Docker.ExecCreateOptions) => {
+        const exec = attached({ ...createOptions, Cmd: execOptions.Cmd, Env: execOptions.Env });
+        execs.push(exec.kill);
+        return {
+          start: async () => exec.stream,
+          inspect: async () => ({ ExitCode: await exec.finished }),
+        };
+      },
+      inspect: async () => ({ State: { ExitCode: exitCode, Running: running, OOMKilled: false } }),
+      kill: async () => {
+        kill();
+        execs.forEach((killExec) => killExec());
+        running = false;
+      },
+      remove: async () => {},
+    };
+  };
+
+  const docker = {
+    createContainer,
+    buildImage: async (_context: unknown, buildOptions: { t: string }) => {
+      built.push(buildOptions.t);
+      images.add(buildOptions.t);
+      return new PassThrough();
+    },
+    getImage: (tag: string) => ({
+      inspect: async () => {
+        if (!images.has(tag)) {
+          throw notFound(`No such image: ${tag}`);
+        }
+        return { Id: tag };
+      },
+      remove: async () => {
+        removed.images.push(tag);
+        listing.images = listing.images.filter((image) => image.Id !== tag);
+      },
+    }),
+    getContainer: (id: string) => ({
+      remove: async () => {
+        removed.containers.push(id);
+        listing.containers = listing.containers.filter((container) => container.Id !== id);
+      },
+    }),
+    getVolume: (name: string) => ({
+      remove: async () => {
+        removed.volumes.push(name);
+        listing.volumes = listing.volumes.filter((volume) => volume.Name !== name);
+      },
+    }),
+    createVolume: async () => ({}),
+    listContainers: async (listOptions?: ListOptions) =>
+      listing.containers.filter((container) => matchesLabels(container.Labels, listOptions)),
+    listImages: async (listOptions?: ListOptions) =>
+      listing.images.filter((image) => matchesLabels(image.Labels, listOptions)),
+    listVolumes: async (listOptions?: ListOptions) => ({
+      Volumes: listing.volumes.filter((volume) => matchesLabels(volume.Labels, listOptions)),
+    }),
+    info: async () => ({ Runtimes: { runc: {} } }),
+    ping: async () => 'OK',
+    modem: {
+      demuxStream: (stream: NodeJS.ReadableStream, stdout: Writable, stderr: Writable) => {
+        outputs.set(stream, { stdout, stderr });
+        stream.resume();
+      },
+      followProgress: (
+        _stream: unknown,
+        onFinished: (error: Error | null, output: unknown[]) => void
+      ) => onFinished(null, []),
+    },
+  };
+
+  return { docker: docker as unknown as DockerClient, images, created, built, removed };
+};
+
+// A configuration with a workspace directory of its own under the OS temp
+// directory.
+export const createTestConfig = async (
+  overrides: Partial<RunnerConfig> = {}
+): Promise<RunnerConfig> => ({
+  runnerId: 'test-runner',
+  privateKey: '',
+  publicKey: '',
+  apiUrl: 'http://localhost:3000',
+  dockerSocket: '/var/run/docker.sock',
+  concurrency: 2,
+  maxExecutionTime: 10000,
+  maxMemory: 512 * 1024 * 1024,
+  networkDisabled: true,
+  workspaceDir: await mkdtemp(join(tmpdir(), 'codecontest-test-')),
+  autoBuildImages: true,
+  maxSourceBytes: 4 * 1024 * 1024,
+  maxSourceFileBytes: 1024 * 1024,
+  buildCacheVolumes: false,
+  pruneImagesOnStart: false,
+  ...overrides,
+});
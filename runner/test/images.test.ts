@@ -0,0 +1,108 @@
+import { test, after } from 'node:test';
+import assert from 'node:assert/strict';
+import { rm } from 'fs/promises';
+import { ImageNotBuiltError } from '../src/errors.js';
+import { execute } from '../src/executor.js';
+import { imageTag, OWNER_LABEL, OWNER_LABEL_VALUE, pruneImages } from '../src/images.js';
+import { getLanguage } from '../src/languages.js';
+import { createFakeDocker, createTestConfig, notFound } from './fake-docker.js';
+
+const config = await createTestConfig();
+const tag = imageTag(getLanguage('javascript')!);
+
+after(() => rm(config.workspaceDir, { recursive: true, force: true }));
+
+test('a missing image on create is an ImageNotBuiltError without auto-build', async () => {
+  const fake = createFakeDocker({
+    images: [tag],
+    createError: () => notFound(`No such image: ${tag}`),
+  });
+
+  await assert.rejects(
+    execute(fake.docker, { language: 'javascript', code: '' }, { ...config, autoBuildImages: false }),
+    (error) => {
+      assert.ok(error instanceof ImageNotBuiltError);
+      assert.equal(error.language, 'javascript');
+      return true;
+    }
+  );
+  assert.deepEqual(fake.built, []);
+});
+
+test('a missing image on create is rebuilt and the run retried with auto-build', async () => {
+  let pruned = false;
+  const fake = createFakeDocker({
+    images: [tag],
+    // The image is removed after the runner last saw it, e.g. by a prune.
+    createError: () => {
+      if (pruned) {
+        return undefined;
+      }
+      pruned = true;
+      fake.images.delete(tag);
+      return notFound(`No such image: ${tag}`);
+    },
+    run: () => ({ stdout: 'ok\n' }),
+  });
+
+  const result = await execute(fake.docker, { language: 'javascript', code: '' }, config);
+
+  assert.equal(result.stdout, 'ok\n');
+  assert.deepEqual(fake.built, [tag]);
+  assert.equal(fake.created.length, 1);
+});
+
+test('other create failures are passed on as they are', async () => {
+  const failure = Object.assign(new Error('conflict'), { statusCode: 409 });
+  const fake = createFakeDocker({ images: [tag], createError: () => failure });
+
+  await assert.rejects(execute(fake.docker, { language: 'javascript', code: '' }, config), failure);
+});
+
+test('pruning keeps the newest image per language and any image in use', async () => {
+  const python = getLanguage('python')!;
+  const labels = (language: string, version: string) => ({
+    [OWNER_LABEL]: OWNER_LABEL_VALUE,
+    language,
+    version,
+  });
+  const fake = createFakeDocker({
+    listing: {
+      images: [
+        // Built from an earlier revision of the Dockerfile.
+        {
+          Id: 'python-old',
+          Created: 100,
+          RepoTags: ['codecontest/python-runner:0123456789ab'],
+          Labels: labels('python', python.version),
+        },
+        {
+          Id: 'python-current',
+          Created: 200,
+          RepoTags: [imageTag(python)],
+          Labels: labels('python', python.version),
+        },
+        {
+          Id: 'javascript-old',
+          Created: 100,
+          RepoTags: ['codecontest/javascript-runner:0123456789ab'],
+          Labels: labels('javascript', getLanguage('javascript')!.version),
+        },
+        {
+          Id: 'javascript-current',
+          Created: 200,
+          RepoTags: [tag],
+          Labels: labels('javascript', getLanguage('javascript')!.version),
+        },
+        // Not built by the runner.
+        { Id: 'someone-elses', Created: 50, Labels: { language: 'python', version: python.version } },
+      ],
+      containers: [{ Id: 'still-running', ImageID: 'javascript-old' }],
+    },
+  });
+
+  const removed = await pruneImages(fake.docker, 1);
+
+  assert.deepEqual(removed, ['python-old']);
+  assert.deepEqual(fake.removed.images, ['python-old']);
+});
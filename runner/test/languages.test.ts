@@ -0,0 +1,42 @@
+import { test } from 'node:test';
+import assert from 'node:assert/strict';
+import { detectLanguage, getLanguage, resolveEntryPoint } from '../src/languages.js';
+
+test('file extensions map to registered languages', () => {
+  const table: Array<[string, string | undefined]> = [
+    ['main.go', 'go'],
+    ['main.py', 'python'],
+    ['index.js', 'javascript'],
+    ['main.cpp', 'cpp'],
+    ['main.cc', 'cpp'],
+    ['main.cxx', 'cpp'],
+    ['main.c', 'c'],
+    ['main.rs', 'rust'],
+    ['Main.java', 'java'],
+    ['main.rb', 'ruby'],
+    ['src/MAIN.PY', 'python'],
+    ['notes.txt', undefined],
+    ['Makefile', undefined],
+    ['main.', undefined],
+    ['dir.py/main', undefined],
+    ['', undefined],
+  ];
+
+  for (const [fileName, language] of table) {
+    assert.equal(detectLanguage(fileName), language, fileName);
+  }
+});
+
+test('Java sources are named after their public class', () => {
+  const java = getLanguage('java')!;
+
+  assert.deepEqual(
+    resolveEntryPoint(java, 'import java.util.*;\n\npublic class Solution {\n}\n'),
+    { fileName: 'Solution.java', runCommand: ['java', '-cp', '/workspace', 'Solution'] }
+  );
+  assert.deepEqual(
+    resolveEntryPoint(java, 'package contest.a;\n// public class Decoy\npublic final class B {}\n'),
+    { fileName: 'contest/a/B.java', runCommand: ['java', '-cp', '/workspace', 'contest.a.B'] }
+  );
+  assert.equal(resolveEntryPoint(java, 'class Helper {}\n').fileName, 'Main.java');
+});
@@ -0,0 +1,84 @@
+import { test, after } from 'node:test';
+import assert from 'node:assert/strict';
+import { existsSync } from 'fs';
+import { rm, writeFile } from 'fs/promises';
+import { join } from 'path';
+import { createContainerPool } from '../src/pool.js';
+import { noopLogger } from '../src/logger.js';
+import { createFakeDocker, createTestConfig, FakeRun } from './fake-docker.js';
+
+const config = await createTestConfig();
+
+after(() => rm(config.workspaceDir, { recursive: true, force: true }));
+
+const isReset = ({ options }: FakeRun) =>
+  (options.Cmd as string[]).join(' ').includes('kill -9 -1');
+
+// Lets pending I/O and timers run until check passes.
+const until = async (check: () => boolean) => {
+  const deadline = Date.now() + 5000;
+  while (!check()) {
+    assert.ok(Date.now() < deadline, 'condition never became true');
+    await new Promise((resolve) => setImmediate(resolve));
+  }
+};
+
+test('only interpreted languages with the default limits are pooled', async () => {
+  const fake = createFakeDocker();
+  const pool = createContainerPool(
+    fake.docker,
+    config,
+    { size: 1, languages: ['python', 'c'] },
+    noopLogger
+  );
+
+  assert.equal(pool.supports({ language: 'python', code: '' }), true);
+  assert.equal(pool.supports({ language: 'ruby', code: '' }), false);
+  assert.equal(pool.supports({ language: 'c', code: '' }), false);
+  assert.equal(pool.supports({ language: 'python', code: '', memoryLimitBytes: 1 << 20 }), false);
+  assert.equal(pool.supports({ language: 'python', code: '', network: 'bridge' }), false);
+  assert.equal(pool.supports({ language: 'python', code: '', dependencies: ['requests'] }), false);
+
+  await pool.close();
+});
+
+test('a reused container keeps nothing of the previous run', async () => {
+  const runs: FakeRun[] = [];
+  const seen: boolean[] = [];
+  let resets = 0;
+  const fake = createFakeDocker({
+    run: async (run) => {
+      if (isReset(run)) {
+        resets++;
+        return {};
+      }
+      runs.push(run);
+      seen.push(existsSync(join(run.workspace!, 'secret.txt')));
+      await writeFile(join(run.workspace!, 'secret.txt'), 'from run A');
+      return {};
+    },
+    // Only the first container starts, so the second run has to reuse it.
+    createError: () => (fake.created.length > 0 ? new Error('no more containers') : undefined),
+  });
+  const pool = createContainerPool(
+    fake.docker,
+    config,
+    { size: 1, languages: ['python'] },
+    noopLogger
+  );
+  await until(() => fake.created.length === 1);
+
+  await pool.execute({ language: 'python', code: '', env: { OWNER: 'a' } });
+  await until(() => resets === 1);
+  await until(() => !existsSync(join(runs[0].workspace!, 'secret.txt')));
+  await new Promise((resolve) => setImmediate(resolve));
+  await pool.execute({ language: 'python', code: '' });
+
+  assert.equal(fake.created.length, 1);
+  assert.equal(runs[1].workspace, runs[0].workspace);
+  assert.deepEqual(seen, [false, false]);
+  assert.ok(runs[0].options.Env?.includes('OWNER=a'));
+  assert.ok(!runs[1].options.Env?.some((entry) => entry.startsWith('OWNER=')));
+
+  await pool.close();
+});
@@ -0,0 +1,245 @@
+import { test, after } from 'node:test';
+import assert from 'node:assert/strict';
+import { getEventListeners } from 'events';
+import { existsSync } from 'fs';
+import { mkdir, rm } from 'fs/promises';
+import { join } from 'path';
+import { Registry } from 'prom-client';
+import { ShuttingDownError } from '../src/errors.js';
+import { runnerLabels } from '../src/images.js';
+import { LogFields, RunnerLogger } from '../src/logger.js';
+import { createRunner } from '../src/runner.js';
+import { createFakeDocker, createTestConfig } from './fake-docker.js';
+
+const config = await createTestConfig();
+
+after(() => rm(config.workspaceDir, { recursive: true, force: true }));
+
+test('runs a program in a labelled container and returns its output', async () => {
+  const fake = createFakeDocker({ run: ({ stdin }) => ({ stdout: `read ${stdin}\n` }) });
+  const runner = createRunner(fake.docker, config);
+
+  const result = await runner.execute({ language: 'python', code: 'print(input())', stdin: 'hi' });
+
+  assert.equal(result.stdout, 'read hi\n');
+  assert.equal(result.exitCode, 0);
+  assert.equal(result.timedOut, false);
+  assert.equal(fake.created.length, 1);
+  assert.match(fake.created[0].Image ?? '', /^codecontest\/python-runner:/);
+  assert.equal(fake.created[0].Labels?.['codecontest.runner-id'], config.runnerId);
+  assert.equal(fake.created[0].HostConfig?.NetworkMode, 'none');
+});
+
+test('picks the language from the file name when none is given', async () => {
+  const fake = createFakeDocker();
+  const runner = createRunner(fake.docker, config);
+
+  await runner.execute({ fileName: 'solution.rb', code: 'puts 1' });
+
+  assert.match(fake.created[0].Image ?? '', /^codecontest\/ruby-runner:/);
+});
+
+test('a cache hit creates no container', async () => {
+  const fake = createFakeDocker({ run: () => ({ stdout: '42\n' }) });
+  const runner = createRunner(fake.docker, config, { cache: {} });
+  const request = { language: 'python', code: 'print(42)', deterministic: true };
+
+  const first = await runner.execute(request);
+  const second = await runner.execute(request);
+
+  assert.equal(fake.created.length, 1);
+  assert.deepEqual(second, first);
+  assert.deepEqual(runner.cacheStats(), { hits: 1, misses: 1 });
+});
+
+// Lets pending I/O and timers run until check passes.
+const until = async (check: () => boolean) => {
+  const deadline = Date.now() + 5000;
+  while (!check()) {
+    assert.ok(Date.now() < deadline, 'condition never became true');
+    await new Promise((resolve) => setImmediate(resolve));
+  }
+};
+
+test('a job past maxConcurrency gets no container until a slot frees up', async () => {
+  const finish: Array<() => void> = [];
+  const fake = createFakeDocker({
+    run: () => new Promise((resolve) => finish.push(() => resolve({}))),
+  });
+  const runner = createRunner(fake.docker, config, { maxConcurrency: 2 });
+
+  const jobs = [1, 2, 3].map((n) => runner.execute({ language: 'python', code: `print(${n})` }));
+
+  await until(() => finish.length === 2);
+  assert.equal(fake.created.length, 2);
+  assert.equal(runner.inFlight(), 2);
+  assert.equal(runner.queued(), 1);
+
+  finish.shift()!();
+  await until(() => finish.length === 2);
+  assert.equal(fake.created.length, 3);
+  assert.equal(runner.inFlight(), 2);
+  assert.equal(runner.queued(), 0);
+
+  finish.splice(0).forEach((done) => done());
+  await Promise.all(jobs);
+  assert.equal(runner.inFlight(), 0);
+});
+
+test('cleanup removes only what carries this runner\'s labels', async () => {
+  const ours = runnerLabels(config);
+  const theirs = runnerLabels({ ...config, runnerId: 'other-runner' });
+  const fake = createFakeDocker({
+    listing: {
+      containers: [
+        // Left behind by a run this runner was killed in the middle of.
+        { Id: 'orphan', Labels: ours },
+        { Id: 'other-runner', Labels: theirs },
+        { Id: 'unrelated' },
+      ],
+      volumes: [
+        { Name: 'our-cache', Labels: ours },
+        { Name: 'their-cache', Labels: theirs },
+      ],
+    },
+  });
+  const leftover = join(config.workspaceDir, `${config.runnerId}-crashed`);
+  const foreign = join(config.workspaceDir, 'other-runner-crashed');
+  await mkdir(leftover);
+  await mkdir(foreign);
+
+  await createRunner(fake.docker, config).cleanup();
+
+  assert.deepEqual(fake.removed.containers, ['orphan']);
+  assert.deepEqual(fake.removed.volumes, ['our-cache']);
+  assert.equal(existsSync(leftover), false);
+  assert.equal(existsSync(foreign), true);
+});
+
+test('a run that times out increments the timeout counter', async () => {
+  const registry = new Registry();
+  // Runs until the runner kills the container.
+  const fake = createFakeDocker({ run: () => new Promise(() => {}) });
+  const runner = createRunner(fake.docker, config, { metrics: registry });
+
+  const result = await runner.execute({ language: 'python', code: 'while True: pass', timeout: 20 });
+
+  assert.equal(result.timedOut, true);
+  const runs = await registry.getSingleMetric('codecontest_runner_executions_total')!.get();
+  assert.deepEqual(
+    runs.values.map(({ labels, value }) => ({ ...labels, value })),
+    [{ language: 'python', outcome: 'timeout', value: 1 }]
+  );
+});
+
+test('shutdown lets an in-flight run finish and refuses new calls', async () => {
+  let finish = () => {};
+  const fake = createFakeDocker({
+    run: () => new Promise((resolve) => (finish = () => resolve({ stdout: 'done\n' }))),
+  });
+  const runner = createRunner(fake.docker, config);
+
+  const running = runner.execute({ language: 'python', code: '' });
+  await until(() => fake.created.length === 1);
+  const stopped = runner.shutdown();
+
+  const request = { language: 'python', code: '' };
+  await assert.rejects(runner.execute(request), ShuttingDownError);
+  await assert.rejects(runner.validate(request), ShuttingDownError);
+  await assert.rejects(runner.startSession('python'), ShuttingDownError);
+
+  finish();
+  assert.equal((await running).stdout, 'done\n');
+  await stopped;
+  assert.equal(fake.created.length, 1);
+});
+
+test('a run killed once shutdown runs out of time fails with ShuttingDownError', async () => {
+  // Runs until the runner kills the container.
+  const fake = createFakeDocker({ run: () => new Promise(() => {}) });
+  const runner = createRunner(fake.docker, config);
+
+  const running = runner.execute({ language: 'python', code: 'while True: pass' });
+  await until(() => fake.created.length === 1);
+  const grace = new AbortController();
+  const stopped = runner.shutdown(grace.signal);
+  grace.abort();
+
+  await assert.rejects(running, ShuttingDownError);
+  await stopped;
+});
+
+// A logger that keeps every event it is given.
+const capturingLogger = () => {
+  const events: Array<{ level: string; message: string; fields: LogFields }> = [];
+  const at =
+    (level: string) =>
+    (message: string, fields: LogFields = {}) =>
+      events.push({ level, message, fields });
+  const logger: RunnerLogger = { debug: at('debug'), info: at('info'), warn: at('warn') };
+  return { logger, events };
+};
+
+test('runs are logged with their language and outcome', async () => {
+  const { logger, events } = capturingLogger();
+  let calls = 0;
+  // The first run succeeds, the second runs until it is killed.
+  const fake = createFakeDocker({ run: () => (calls++ === 0 ? {} : new Promise(() => {})) });
+  const runner = createRunner(fake.docker, config, { logger });
+
+  await runner.execute({ language: 'python', code: 'print(1)' });
+  await runner.execute({ language: 'python', code: 'while True: pass', timeout: 20 });
+
+  const created = events.filter((event) => event.message === 'Container created');
+  assert.equal(created.length, 2);
+  assert.ok(created.every((event) => event.fields.language === 'python'));
+
+  const killed = events.find((event) => event.message === 'Killing container');
+  assert.equal(killed?.fields.reason, 'timeout');
+
+  const finished = events.filter((event) => event.message === 'Run finished');
+  assert.deepEqual(
+    finished.map(({ level, fields }) => [level, fields.language, fields.outcome]),
+    [
+      ['info', 'python', 'success'],
+      ['info', 'python', 'timeout'],
+    ]
+  );
+});
+
+test('a batch settles each request on its own and leaves no listeners behind', async () => {
+  const fake = createFakeDocker({
+    run: ({ options }) => {
+      const command = (options.Cmd as string[]).join(' ');
+      if (command.includes('gcc')) {
+        return { stderr: 'main.c:1:1: error: expected expression\n', exitCode: 1 };
+      }
+      // Runs until the runner kills the container.
+      return command.includes('slow.py') ? new Promise(() => {}) : { stdout: 'ok\n' };
+    },
+  });
+  const runner = createRunner(fake.docker, config);
+  const batch = new AbortController();
+
+  const results = await runner.executeBatch(
+    [
+      { language: 'python', code: 'print("ok")' },
+      { language: 'c', code: 'int main(void) { return }\n' },
+      { language: 'python', code: '', args: ['slow.py'], timeout: 20 },
+      { language: 'cobol', code: '' },
+    ].map((request) => ({ ...request, signal: new AbortController().signal })),
+    batch.signal
+  );
+
+  assert.deepEqual(
+    results.map((settled) => settled.status),
+    ['fulfilled', 'fulfilled', 'fulfilled', 'rejected']
+  );
+  const [ok, compileError, timeout] = results.map((settled) =>
+    settled.status === 'fulfilled' ? settled.value : undefined
+  );
+  assert.equal(ok?.stdout, 'ok\n');
+  assert.match(compileError?.compileError ?? '', /expected expression/);
+  assert.equal(timeout?.timedOut, true);
+  assert.equal(getEventListeners(batch.signal, 'abort').length, 0);
+});
@@ -0,0 +1,115 @@
+import { test, after } from 'node:test';
+import assert from 'node:assert/strict';
+import { once } from 'events';
+import { rm } from 'fs/promises';
+import { Server } from 'http';
+import { SourceTooLargeError, UnknownLanguageError } from '../src/errors.js';
+import { ExecutionRequest, ExecutionResult } from '../src/executor.js';
+import { Runner } from '../src/runner.js';
+import { createServer, ServerOptions } from '../src/server.js';
+import { createTestConfig } from './fake-docker.js';
+
+const config = await createTestConfig();
+const servers: Server[] = [];
+
+after(async () => {
+  servers.forEach((server) => server.close());
+  await rm(config.workspaceDir, { recursive: true, force: true });
+});
+
+const RESULT: ExecutionResult = {
+  stdout: 'hi\n',
+  stderr: '',
+  exitCode: 0,
+  timedOut: false,
+  oomKilled: false,
+  outputTruncated: false,
+  duration: 5,
+};
+
+// Serves a runner with only the given methods on an ephemeral port and
+// returns the server's base URL.
+const serve = async (runner: Partial<Runner>, options: ServerOptions = {}): Promise<string> => {
+  const server = createServer(runner as Runner, config, options);
+  servers.push(server);
+  server.listen(0, '127.0.0.1');
+  await once(server, 'listening');
+  return `http://127.0.0.1:${(server.address() as { port: number }).port}`;
+};
+
+const post = (url: string, body: string) =>
+  fetch(`${url}/execute`, {
+    method: 'POST',
+    headers: { 'Content-Type': 'application/json' },
+    body,
+  });
+
+test('POST /execute answers with the run result', async () => {
+  const requests: ExecutionRequest[] = [];
+  const url = await serve({
+    execute: async (request) => {
+      requests.push(request);
+      return RESULT;
+    },
+  });
+
+  const response = await post(url, JSON.stringify({ language: 'python', source: 'print(1)' }));
+
+  assert.equal(response.status, 200);
+  assert.deepEqual(await response.json(), RESULT);
+  assert.equal(requests[0].language, 'python');
+  assert.equal(requests[0].code, 'print(1)');
+  assert.equal(requests[0].timeout, config.maxExecutionTime);
+});
+
+test('bad requests are answered with 400 and oversized source with 413', async () => {
+  const url = await serve({
+    execute: async (request) => {
+      if (request.language === 'cobol') {
+        throw new UnknownLanguageError('cobol', undefined, ['python']);
+      }
+      throw new SourceTooLargeError(2048, 1024, 'main.py');
+    },
+  });
+
+  const unknown = await post(url, JSON.stringify({ language: 'cobol', source: '' }));
+  assert.equal(unknown.status, 400);
+  assert.match((await unknown.json()).error, /Unsupported language: cobol/);
+
+  const malformed = await post(url, '{"language": ');
+  assert.equal(malformed.status, 400);
+  assert.deepEqual(await malformed.json(), { error: 'Request body is not valid JSON' });
+
+  const tooLarge = await post(url, JSON.stringify({ language: 'python', source: 'x' }));
+  assert.equal(tooLarge.status, 413);
+});
+
+test('GET /healthz is 503 when the daemon does not answer', async () => {
+  const url = await serve({
+    ping: async () => {
+      throw new Error('connect ECONNREFUSED /var/run/docker.sock');
+    },
+  });
+
+  const response = await fetch(`${url}/healthz`);
+
+  assert.equal(response.status, 503);
+  assert.equal((await response.json()).status, 'unavailable');
+});
+
+test('a run that only resolves after the request timed out is answered with 504', async () => {
+  const url = await serve(
+    {
+      // Like a killed run: it still resolves, once the signal has aborted.
+      execute: (request) =>
+        new Promise((resolve) =>
+          request.signal!.addEventListener('abort', () => resolve({ ...RESULT, exitCode: 137 }))
+        ),
+    },
+    { requestTimeout: 50 }
+  );
+
+  const response = await post(url, JSON.stringify({ language: 'python', source: '' }));
+
+  assert.equal(response.status, 504);
+});